@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"seo/mirror/backend"
+	"seo/mirror/cache"
 	"seo/mirror/config"
 	"seo/mirror/frontend"
 	"time"
@@ -17,6 +18,9 @@ import (
 type Application struct {
 	FrontendServer *http.Server
 	BackendServer  *http.Server
+	evictor        *cache.Evictor
+	janitor        *cache.Janitor
+	health         *frontend.HealthCheck
 }
 
 func (app *Application) Start() {
@@ -38,6 +42,9 @@ func (app *Application) Start() {
 		return
 	}
 	app.BackendServer = &http.Server{Handler: b, Addr: ":" + config.Conf.AdminPort}
+	app.evictor = cache.StartEvictor()
+	app.janitor = cache.StartJanitor(f.CacheExpiry)
+	app.health = f.StartHealthCheck()
 	go func() {
 		if err := app.FrontendServer.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			slog.Error("监听错误" + err.Error())
@@ -62,5 +69,14 @@ func (app *Application) Stop() {
 	if err != nil {
 		slog.Error("shutdown error:" + err.Error())
 	}
+	if app.evictor != nil {
+		app.evictor.Stop()
+	}
+	if app.janitor != nil {
+		app.janitor.Stop()
+	}
+	if app.health != nil {
+		app.health.Stop()
+	}
 	defer cancel()
 }
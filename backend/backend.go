@@ -8,16 +8,20 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"seo/mirror/cache"
 	"seo/mirror/config"
 	"seo/mirror/db"
 	"seo/mirror/frontend"
 	"seo/mirror/helper"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/xuri/excelize/v2"
 )
@@ -29,6 +33,22 @@ type Backend struct {
 	Password string
 	prefix   string
 }
+type siteItem struct {
+	db.SiteConfig
+	CacheUsage   string `json:"cache_usage"`
+	WarmStatus   string `json:"warm_status"`
+	OriginStatus string `json:"origin_status"`
+	RetryStatus  string `json:"retry_status"`
+}
+
+type cacheItem struct {
+	cache.Entry
+	SizeText string `json:"size_text"`
+}
+
+// cachePreviewSize 缓存详情中文本内容最多显示的字节数
+const cachePreviewSize = 4096
+
 type User struct {
 	UserName string `json:"user_name"`
 	Password string `json:"password"`
@@ -67,6 +87,16 @@ func (b *Backend) Initialize() {
 
 	b.Mux.Handle(prefix+"/import", b.AuthMiddleware(b.siteImport))
 	b.Mux.Handle(prefix+"/delete_cache", b.AuthMiddleware(b.DeleteCache))
+	b.Mux.Handle(prefix+"/warm_start", b.AuthMiddleware(b.warmStart))
+	b.Mux.Handle(prefix+"/warm_status", b.AuthMiddleware(b.warmStatus))
+	b.Mux.Handle(prefix+"/warm_cancel", b.AuthMiddleware(b.warmCancel))
+	b.Mux.Handle(prefix+"/cache", b.AuthMiddleware(b.cachePage))
+	b.Mux.Handle(prefix+"/cache_list", b.AuthMiddleware(b.cacheList))
+	b.Mux.Handle(prefix+"/cache_entry", b.AuthMiddleware(b.cacheEntry))
+	b.Mux.Handle(prefix+"/cache_purge", b.AuthMiddleware(b.cachePurge))
+	b.Mux.Handle(prefix+"/cache_stats", b.AuthMiddleware(b.cacheStats))
+	b.Mux.Handle(prefix+"/cache_export", b.AuthMiddleware(b.cacheExport))
+	b.Mux.Handle(prefix+"/cache_import", b.AuthMiddleware(b.cacheImport))
 	b.Mux.Handle(prefix+"/multi_del", b.AuthMiddleware(b.multiDel))
 	b.Mux.Handle(prefix+"/forbidden_words", b.AuthMiddleware(b.forbiddenWords))
 	b.Mux.Handle(prefix+"/base_config", b.AuthMiddleware(b.baseConfig))
@@ -265,7 +295,7 @@ func (b *Backend) siteList(writer http.ResponseWriter, request *http.Request) {
 		result["code"] = 0
 		result["msg"] = ""
 		result["count"] = 1
-		result["data"] = []db.SiteConfig{proxy}
+		result["data"] = b.siteItems([]db.SiteConfig{proxy})
 		data, _ := json.Marshal(result)
 		_, _ = writer.Write(data)
 		return
@@ -290,11 +320,29 @@ func (b *Backend) siteList(writer http.ResponseWriter, request *http.Request) {
 	result["code"] = 0
 	result["msg"] = ""
 	result["count"] = count
-	result["data"] = proxies
+	result["data"] = b.siteItems(proxies)
 	data, _ := json.Marshal(result)
 	_, _ = writer.Write(data)
 
 }
+func (b *Backend) siteItems(siteConfigs []db.SiteConfig) []siteItem {
+	items := make([]siteItem, len(siteConfigs))
+	for i := range siteConfigs {
+		items[i] = siteItem{SiteConfig: siteConfigs[i], CacheUsage: helper.FormatSize(cache.DomainUsage(siteConfigs[i].Domain))}
+		if job, ok := b.frontend.WarmJob(siteConfigs[i].Domain); ok {
+			items[i].WarmStatus = job.String()
+		}
+		statuses := make([]string, 0)
+		for _, status := range b.frontend.OriginStatus(siteConfigs[i].Domain) {
+			statuses = append(statuses, status.String())
+		}
+		items[i].OriginStatus = strings.Join(statuses, "；")
+		if stats, ok := b.frontend.RetryStats(siteConfigs[i].Domain); ok && stats.Retries+stats.Denied > 0 {
+			items[i].RetryStatus = stats.String()
+		}
+	}
+	return items
+}
 func (b *Backend) siteSave(writer http.ResponseWriter, request *http.Request) {
 	err := request.ParseForm()
 	if err != nil {
@@ -309,6 +357,21 @@ func (b *Backend) siteSave(writer http.ResponseWriter, request *http.Request) {
 	if err != nil || cacheTime == 0 {
 		cacheTime = 88888888
 	}
+	cacheLimit, _ := strconv.ParseInt(request.Form.Get("cache_limit"), 10, 64)
+	staleTime, _ := strconv.ParseInt(request.Form.Get("stale_while_revalidate"), 10, 64)
+	notFoundTime, _ := strconv.ParseInt(request.Form.Get("not_found_time"), 10, 64)
+	errorTime, _ := strconv.ParseInt(request.Form.Get("error_time"), 10, 64)
+	maxCacheSize, _ := strconv.ParseInt(request.Form.Get("max_cache_size"), 10, 64)
+	healthInterval, _ := strconv.ParseInt(request.Form.Get("health_interval"), 10, 64)
+	dialTimeout, _ := strconv.ParseInt(request.Form.Get("dial_timeout"), 10, 64)
+	tlsTimeout, _ := strconv.ParseInt(request.Form.Get("tls_timeout"), 10, 64)
+	headerTimeout, _ := strconv.ParseInt(request.Form.Get("header_timeout"), 10, 64)
+	requestTimeout, _ := strconv.ParseInt(request.Form.Get("request_timeout"), 10, 64)
+	maxIdleConns, _ := strconv.Atoi(request.Form.Get("max_idle_conns"))
+	maxConnsPerHost, _ := strconv.Atoi(request.Form.Get("max_conns_per_host"))
+	retryAttempts, _ := strconv.Atoi(request.Form.Get("retry_attempts"))
+	retryBackoff, _ := strconv.ParseInt(request.Form.Get("retry_backoff"), 10, 64)
+	retryBudget, _ := strconv.Atoi(request.Form.Get("retry_budget"))
 	i, err := strconv.Atoi(id)
 	if err != nil {
 		_, _ = writer.Write([]byte(`{"code":2,"msg":` + err.Error() + `}`))
@@ -339,22 +402,56 @@ func (b *Backend) siteSave(writer http.ResponseWriter, request *http.Request) {
 		CacheTime:        cacheTime,
 		BaiduPushKey:     "",
 		SmPushKey:        "",
+		CacheStore:       request.Form.Get("cache_store"),
+		CacheLimit:       cacheLimit,
+		StaleTime:        staleTime,
+		OriginCache:      request.Form.Get("origin_cache") == "on",
+		KeyIgnoreParams:  strings.Split(request.Form.Get("key_ignore_params"), ";"),
+		KeyAllowParams:   strings.Split(request.Form.Get("key_allow_params"), ";"),
+		KeySortParams:    request.Form.Get("key_sort_params") == "on",
+		KeyFoldCase:      request.Form.Get("key_fold_case") == "on",
+		KeyTrimSlash:     request.Form.Get("key_trim_slash") == "on",
+		VaryDimensions:   strings.Split(request.Form.Get("vary_dimensions"), ";"),
+		NotFoundTime:     notFoundTime,
+		ErrorTime:        errorTime,
+		MaxCacheSize:     maxCacheSize,
+		CacheRules:       strings.Split(request.Form.Get("cache_rules"), ";"),
+		Origins:          strings.Split(request.Form.Get("origins"), ";"),
+		OriginBalance:    request.Form.Get("origin_balance"),
+		HealthPath:       request.Form.Get("health_path"),
+		HealthInterval:   healthInterval,
+		DialTimeout:      dialTimeout,
+		TLSTimeout:       tlsTimeout,
+		HeaderTimeout:    headerTimeout,
+		RequestTimeout:   requestTimeout,
+		MaxIdleConns:     maxIdleConns,
+		MaxConnsPerHost:  maxConnsPerHost,
+		HTTP2:            request.Form.Get("http2") == "on",
+		RetryAttempts:    retryAttempts,
+		RetryBackoff:     retryBackoff,
+		RetryStatuses:    strings.Split(request.Form.Get("retry_statuses"), ";"),
+		RetryErrors:      strings.Split(request.Form.Get("retry_errors"), ";"),
+		RetryBudget:      retryBudget,
+		OriginEncoding:   request.Form.Get("origin_encoding"),
+		EgressProxy:      strings.TrimSpace(request.Form.Get("egress_proxy")),
+	}
+
+	//先校验配置，出错时不保存，避免错误的配置导致下次启动失败。NewSite 会修改配置，保存的是提交的原始配置
+	raw := siteConfig.Clone()
+	site, err := frontend.NewSite(&siteConfig)
+	if err != nil {
+		_, _ = writer.Write([]byte(`{"code":2,"msg":` + err.Error() + `}`))
+		return
 	}
-
-	if siteConfig.Id == 0 {
-		err = db.AddOne(siteConfig)
+	if raw.Id == 0 {
+		err = db.AddOne(raw)
 	} else {
-		err = db.UpdateById(siteConfig)
+		err = db.UpdateById(raw)
 	}
 	if err != nil {
 		_, _ = writer.Write([]byte(`{"code":1,"msg":` + err.Error() + `}`))
 		return
 	}
-	site, err := frontend.NewSite(&siteConfig)
-	if err != nil {
-		_, _ = writer.Write([]byte(`{"code":2,"msg":` + err.Error() + `}`))
-		return
-	}
 	b.frontend.Sites.Store(site.Domain, site)
 
 	if siteConfig.Id == 0 {
@@ -383,8 +480,8 @@ func (b *Backend) siteDelete(writer http.ResponseWriter, request *http.Request)
 		_, _ = writer.Write([]byte(`{"code":1,"msg":` + err.Error() + `}`))
 		return
 	}
-	b.frontend.Sites.Delete(domain)
 	_ = b.deleteCache(domain)
+	b.frontend.Sites.Delete(domain)
 	_, _ = writer.Write([]byte(`{"code":0}`))
 
 }
@@ -588,16 +685,207 @@ func (b *Backend) deleteCache(domain string) error {
 	if domain == "" {
 		return errors.New("域名不能为空")
 	}
-	dir := config.Conf.CachePath + "/" + domain
-	if !helper.IsExist(dir) {
-		return errors.New("缓存目录不存在")
-	}
-	err := os.RemoveAll(dir)
+	store, err := cache.Open("")
 	if err != nil {
 		return err
 	}
-	return nil
+	if un, ok := b.frontend.Sites.Load(domain); ok {
+		store = un.(*frontend.Site).Store
+	}
+	return store.PurgeDomain(domain)
+}
+func (b *Backend) warmStart(writer http.ResponseWriter, request *http.Request) {
+	err := request.ParseForm()
+	if err != nil {
+		_, _ = writer.Write([]byte(`{"code":5,"msg":"请求数据出错"}`))
+		return
+	}
+	domain := request.Form.Get("domain")
+	if domain == "" {
+		_, _ = writer.Write([]byte(`{"code":4,"msg":"域名不能为空"}`))
+		return
+	}
+	urls := strings.Split(strings.ReplaceAll(request.Form.Get("urls"), "\r", ""), "\n")
+	urls = slices.DeleteFunc(urls, func(u string) bool { return strings.TrimSpace(u) == "" })
+	concurrency, _ := strconv.Atoi(request.Form.Get("concurrency"))
+	rate, _ := strconv.Atoi(request.Form.Get("rate"))
+	_, err = b.frontend.StartWarm(domain, urls, concurrency, rate)
+	if err != nil {
+		data, _ := json.Marshal(map[string]interface{}{"code": 3, "msg": err.Error()})
+		_, _ = writer.Write(data)
+		return
+	}
+	_, _ = writer.Write([]byte(`{"code":0}`))
+}
+
+func (b *Backend) warmStatus(writer http.ResponseWriter, request *http.Request) {
+	job, ok := b.frontend.WarmJob(request.URL.Query().Get("domain"))
+	if !ok {
+		_, _ = writer.Write([]byte(`{"code":4,"msg":"没有预热任务"}`))
+		return
+	}
+	data, _ := json.Marshal(map[string]interface{}{"code": 0, "data": job.Snapshot(), "msg": job.String()})
+	_, _ = writer.Write(data)
+}
+
+func (b *Backend) warmCancel(writer http.ResponseWriter, request *http.Request) {
+	job, ok := b.frontend.WarmJob(request.URL.Query().Get("domain"))
+	if !ok {
+		_, _ = writer.Write([]byte(`{"code":4,"msg":"没有预热任务"}`))
+		return
+	}
+	job.Cancel()
+	_, _ = writer.Write([]byte(`{"code":0}`))
+}
+
+func (b *Backend) cachePage(w http.ResponseWriter, request *http.Request) {
+	t, err := template.ParseFiles("admin/cache.html")
+	if err != nil {
+		slog.Error("cache template error:" + err.Error())
+		return
+	}
+	err = t.Execute(w, map[string]string{"admin_uri": b.prefix, "domain": request.URL.Query().Get("domain")})
+	if err != nil {
+		slog.Error("cache template error:" + err.Error())
+	}
+}
+
+func (b *Backend) cacheList(writer http.ResponseWriter, request *http.Request) {
+	v := request.URL.Query()
+	domain := v.Get("domain")
+	keyword := v.Get("keyword")
+	page, _ := strconv.Atoi(v.Get("page"))
+	limit, _ := strconv.Atoi(v.Get("limit"))
+	if page <= 0 {
+		page = 1
+	}
+	if limit <= 0 {
+		limit = 50
+	}
+	if domain == "" {
+		_, _ = writer.Write([]byte(`{"code":0,"count":0,"data":[]}`))
+		return
+	}
+	un, ok := b.frontend.Sites.Load(domain)
+	if !ok {
+		_, _ = writer.Write([]byte(`{"code":4,"msg":"站点不存在"}`))
+		return
+	}
+	entries := cache.Entries(un.(*frontend.Site).Store, domain)
+	if keyword != "" {
+		entries = slices.DeleteFunc(entries, func(entry cache.Entry) bool { return !strings.Contains(entry.Key, keyword) })
+	}
+	items := make([]cacheItem, 0, limit)
+	start := min((page-1)*limit, len(entries))
+	end := min(start+limit, len(entries))
+	for _, entry := range entries[start:end] {
+		items = append(items, cacheItem{Entry: entry, SizeText: helper.FormatSize(entry.Size)})
+	}
+	data, _ := json.Marshal(map[string]interface{}{"code": 0, "msg": "", "count": len(entries), "data": items})
+	_, _ = writer.Write(data)
+}
+
+func (b *Backend) cacheEntry(writer http.ResponseWriter, request *http.Request) {
+	v := request.URL.Query()
+	domain := v.Get("domain")
+	key := v.Get("key")
+	un, ok := b.frontend.Sites.Load(domain)
+	if !ok {
+		_, _ = writer.Write([]byte(`{"code":4,"msg":"站点不存在"}`))
+		return
+	}
+	reader, err := un.(*frontend.Site).Store.Open(domain, key)
+	if err != nil {
+		data, _ := json.Marshal(map[string]interface{}{"code": 3, "msg": "读取缓存失败：" + err.Error()})
+		_, _ = writer.Write(data)
+		return
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	var preview string
+	if reader.IsMarker() {
+		preview = "变体标记，共" + strconv.Itoa(len(reader.Variants)) + "个变体"
+	} else if cache.Compressible(reader.Header.Get("Content-Type")) {
+		body, err := reader.DecodedBody()
+		if err == nil {
+			content := make([]byte, cachePreviewSize)
+			n, _ := io.ReadFull(body, content)
+			preview = strings.ToValidUTF8(string(content[:n]), "")
+		} else {
+			preview = "解压失败：" + err.Error()
+		}
+	} else {
+		preview = "二进制内容 " + strconv.FormatInt(reader.Size, 10) + " 字节"
+	}
+	data, _ := json.Marshal(map[string]interface{}{"code": 0, "data": map[string]interface{}{"meta": reader.Meta, "preview": preview}})
+	_, _ = writer.Write(data)
+}
+
+func (b *Backend) cachePurge(writer http.ResponseWriter, request *http.Request) {
+	err := request.ParseForm()
+	if err != nil {
+		_, _ = writer.Write([]byte(`{"code":5,"msg":"请求数据出错"}`))
+		return
+	}
+	count, err := b.frontend.PurgeCache(request.Form.Get("domain"), request.Form.Get("mode"), request.Form.Get("value"))
+	if err != nil {
+		data, _ := json.Marshal(map[string]interface{}{"code": 3, "msg": err.Error(), "count": count})
+		_, _ = writer.Write(data)
+		return
+	}
+	data, _ := json.Marshal(map[string]interface{}{"code": 0, "count": count})
+	_, _ = writer.Write(data)
 }
+
+func (b *Backend) cacheStats(writer http.ResponseWriter, request *http.Request) {
+	data, _ := json.Marshal(map[string]interface{}{"code": 0, "data": cache.Stats()})
+	_, _ = writer.Write(data)
+}
+
+func (b *Backend) cacheExport(writer http.ResponseWriter, request *http.Request) {
+	var domains []string
+	for _, domain := range strings.Split(request.URL.Query().Get("domain"), ",") {
+		if domain = strings.TrimSpace(domain); domain == "" {
+			continue
+		}
+		if _, ok := b.frontend.Sites.Load(domain); !ok {
+			data, _ := json.Marshal(map[string]interface{}{"code": 4, "msg": "站点不存在:" + domain})
+			_, _ = writer.Write(data)
+			return
+		}
+		domains = append(domains, domain)
+	}
+	filename := "mirror-cache-" + time.Now().Format("20060102150405") + ".tar.gz"
+	writer.Header().Set("Content-Type", "application/gzip")
+	writer.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	result, err := b.frontend.ExportSites(writer, domains)
+	if err != nil {
+		//已经开始输出文件，只能记录日志
+		slog.Error("导出迁移包失败", "message", err.Error())
+		return
+	}
+	slog.Info("导出迁移包", "result", result.String())
+}
+
+func (b *Backend) cacheImport(writer http.ResponseWriter, request *http.Request) {
+	mf, _, err := request.FormFile("file")
+	if err != nil {
+		data, _ := json.Marshal(map[string]interface{}{"code": 1, "msg": err.Error()})
+		_, _ = writer.Write(data)
+		return
+	}
+	defer mf.Close()
+	result, err := b.frontend.ImportSites(mf, request.FormValue("overwrite") == "on")
+	if err != nil {
+		data, _ := json.Marshal(map[string]interface{}{"code": 2, "msg": err.Error(), "data": result})
+		_, _ = writer.Write(data)
+		return
+	}
+	data, _ := json.Marshal(map[string]interface{}{"code": 0, "msg": result.String(), "data": result})
+	_, _ = writer.Write(data)
+}
+
 func (b *Backend) saveInjectJs(writer http.ResponseWriter, request *http.Request) {
 	var params map[string]string
 	err := json.NewDecoder(request.Body).Decode(&params)
@@ -0,0 +1,40 @@
+package cache
+
+import (
+	"errors"
+)
+
+// Decode 解析 Encode 写出的数据并校验，不接受旧格式
+func Decode(data []byte, resp *Response) error {
+	legacy, err := decodeBytes(data, resp)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		return errors.New("不支持的缓存格式")
+	}
+	return nil
+}
+
+// Export 逐条读取域名下的缓存交给 fn，读取失败或没有缓存键的旧缓存跳过，返回导出和跳过的数量
+func Export(store Store, domain string, fn func(resp *Response) error) (exported, skipped int, err error) {
+	//索引在 Open 后由后台统计填充，刚启动时直接导出会漏掉已有的缓存
+	waitScan(store)
+	for _, entry := range Entries(store, domain) {
+		if entry.Key == "" {
+			skipped++
+			continue
+		}
+		resp := new(Response)
+		if store.Get(domain, entry.Key, resp) != nil {
+			skipped++
+			continue
+		}
+		err = fn(resp)
+		if err != nil {
+			return exported, skipped, err
+		}
+		exported++
+	}
+	return exported, skipped, nil
+}
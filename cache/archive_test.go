@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	source := &trackedStore{hashStore: NewFileStore(t.TempDir())}
+	target := &trackedStore{hashStore: NewFileStore(t.TempDir())}
+	domain := "archive.test"
+	bodies := map[string]string{"/a": "a body", "/b": "b body", "/broken": "broken body"}
+	for key, body := range bodies {
+		resp := &Response{Meta: Meta{StatusCode: 200, Header: http.Header{"Content-Type": {"text/plain"}}}, Body: []byte(body)}
+		if err := source.Put(domain, key, resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//损坏的缓存读取失败，跳过不导出
+	filename := source.hashStore.(*FileStore).filename(domain, "/broken")
+	data, _ := os.ReadFile(filename)
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive [][]byte
+	exported, skipped, err := Export(source, domain, func(resp *Response) error {
+		var buf bytes.Buffer
+		err := Encode(&buf, resp)
+		archive = append(archive, buf.Bytes())
+		return err
+	})
+	if err != nil || exported != 2 || skipped != 1 {
+		t.Fatalf("导出 %d 条，跳过 %d 条:%v", exported, skipped, err)
+	}
+	for _, data := range archive {
+		resp := new(Response)
+		if err = Decode(data, resp); err != nil {
+			t.Fatal(err)
+		}
+		if err = target.Put(domain, resp.Key, resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"/a", "/b"} {
+		resp := new(Response)
+		if err = target.Get(domain, key, resp); err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Body) != bodies[key] || resp.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("%s 导入后的内容为 %q", key, resp.Body)
+		}
+	}
+	if err = Decode([]byte("not a cache"), new(Response)); err == nil {
+		t.Fatal("不是缓存格式的数据应当解析失败")
+	}
+}
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+const EncodingGzip = "gzip"
+
+// 太小的内容压缩后反而可能变大
+const minCompressSize = 256
+
+var compressibleTypes = []string{"text/", "javascript", "json", "xml", "css", "svg"}
+
+var gzipWriterPool = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+// Compressible 是否为值得压缩的内容类型，图片视频等本身已经压缩过
+func Compressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, t := range compressibleTypes {
+		if strings.Contains(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compress 用 gzip 压缩正文后保存，压缩后没有变小时保持原样
+func Compress(resp *Response) error {
+	if resp.Encoding != "" || len(resp.Body) < minCompressSize || !Compressible(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(resp.Body) / 3)
+	zw := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(zw)
+	zw.Reset(&buf)
+	_, err := zw.Write(resp.Body)
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	if buf.Len() >= len(resp.Body) {
+		return nil
+	}
+	resp.Body = buf.Bytes()
+	resp.Encoding = EncodingGzip
+	return nil
+}
+
+// decode 返回解压后的正文
+func decode(r io.Reader, encoding string) (io.Reader, error) {
+	if encoding == EncodingGzip {
+		return gzip.NewReader(r)
+	}
+	return r, nil
+}
+
+// DecodedBody 流式读取解压后的正文，不校验
+func (r *Reader) DecodedBody() (io.Reader, error) {
+	return decode(r.Body, r.Encoding)
+}
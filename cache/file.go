@@ -0,0 +1,322 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"seo/mirror/helper"
+	"strings"
+	"time"
+)
+
+// 写入中的临时文件名为 hash.tmp 加随机后缀，隔离的损坏缓存放在 root/.quarantine/domain 下
+const (
+	tempSuffix    = ".tmp"
+	quarantineDir = ".quarantine"
+	//超过这个时间还没改名的临时文件是崩溃遗留的
+	tempMaxAge = time.Hour
+)
+
+// FileStore 每个缓存一个文件，路径为 root/domain/hash[:2]/hash
+type FileStore struct {
+	root string
+}
+
+func NewFileStore(root string) *FileStore {
+	return &FileStore{root: root}
+}
+
+func (fs *FileStore) filename(domain, key string) string {
+	hash := hashKey(key)
+	return path.Join(fs.root, domain, hash[:2], hash)
+}
+
+func (fs *FileStore) Get(domain, key string, resp *Response) error {
+	data, err := os.ReadFile(fs.filename(domain, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	legacy, err := decodeBytes(data, resp)
+	if err != nil {
+		return corrupt(err)
+	}
+	if legacy {
+		fs.migrate(domain, key, resp)
+	}
+	return nil
+}
+
+func (fs *FileStore) Open(domain, key string) (*Reader, error) {
+	filename := fs.filename(domain, key)
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	reader := &Reader{closer: file}
+	offset, legacy, err := decodeMeta(file, fileInfo.Size(), &reader.Meta)
+	if err != nil {
+		_ = file.Close()
+		return nil, corrupt(err)
+	}
+	if !legacy {
+		//流式输出时不校验正文，先用文件大小排除写了一半的缓存
+		if fileInfo.Size() != offset+reader.Size {
+			_ = file.Close()
+			return nil, ErrCorrupt
+		}
+		reader.Body = io.NewSectionReader(file, offset, reader.Size)
+		return reader, nil
+	}
+	_ = file.Close()
+	resp := new(Response)
+	err = fs.Get(domain, key, resp)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{Meta: resp.Meta, Body: bytes.NewReader(resp.Body)}, nil
+}
+
+// migrate 旧格式的缓存转存为新格式，保留原来的缓存时间
+func (fs *FileStore) migrate(domain, key string, resp *Response) {
+	filename := fs.filename(domain, key)
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		return
+	}
+	resp.Created = fileInfo.ModTime()
+	err = fs.Put(domain, key, resp)
+	if err != nil {
+		slog.Error("迁移缓存失败", filename, err.Error())
+		return
+	}
+	_ = os.Chtimes(filename, resp.Created, resp.Created)
+}
+
+func (fs *FileStore) Put(domain, key string, resp *Response) error {
+	prepare(key, resp)
+	return fs.write(domain, key, &resp.Meta, bytes.NewReader(resp.Body))
+}
+
+// putStream meta 中的 Size 和 Checksum 由调用方按 body 计算好
+func (fs *FileStore) putStream(domain, key string, meta *Meta, body io.Reader) error {
+	meta.Key = key
+	return fs.write(domain, key, meta, body)
+}
+
+func (fs *FileStore) write(domain, key string, meta *Meta, body io.Reader) error {
+	filename := fs.filename(domain, key)
+	dir := path.Dir(filename)
+	if !helper.IsExist(dir) {
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			slog.Error("mkdirAll error", dir, err.Error())
+			return err
+		}
+	}
+	//先写临时文件再改名，进程崩溃或磁盘写满时不会留下写了一半的缓存，并发写入时后写的覆盖先写的
+	file, err := os.CreateTemp(dir, path.Base(filename)+tempSuffix+"*")
+	if err != nil {
+		slog.Error("os.CreateTemp error", filename, err.Error())
+		return err
+	}
+	tempName := file.Name()
+	err = encodeStream(file, meta, body)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempName, filename)
+	}
+	if err != nil {
+		_ = os.Remove(tempName)
+		slog.Error("write cache error", filename, err.Error())
+		return err
+	}
+	return nil
+}
+
+// createTemp 在缓存文件所在目录创建临时文件，命名和 write 一致，崩溃遗留的同样会被清理
+func (fs *FileStore) createTemp(domain, key string) (*os.File, error) {
+	filename := fs.filename(domain, key)
+	err := os.MkdirAll(path.Dir(filename), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(path.Dir(filename), path.Base(filename)+tempSuffix+"*")
+}
+
+// commitTemp 写完的临时文件改名为缓存文件
+func (fs *FileStore) commitTemp(domain, key, tempName string, meta *Meta) error {
+	return os.Rename(tempName, fs.filename(domain, key))
+}
+
+func (fs *FileStore) Delete(domain, key string) error {
+	err := os.Remove(fs.filename(domain, key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (fs *FileStore) PurgeDomain(domain string) error {
+	dir := path.Join(fs.root, domain)
+	if !helper.IsExist(dir) {
+		return errors.New("缓存目录不存在")
+	}
+	return os.RemoveAll(dir)
+}
+
+func (fs *FileStore) Stat(domain, key string) (Info, error) {
+	fileInfo, err := os.Stat(fs.filename(domain, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Info{}, ErrNotFound
+		}
+		return Info{}, err
+	}
+	return Info{Size: fileInfo.Size(), ModTime: fileInfo.ModTime()}, nil
+}
+
+func (fs *FileStore) deleteHash(domain, hash string) error {
+	err := os.Remove(path.Join(fs.root, domain, hash[:2], hash))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (fs *FileStore) walk(fn func(domain, hash string, info Info) error) error {
+	domains, err := os.ReadDir(fs.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, domain := range domains {
+		if !domain.IsDir() || strings.HasPrefix(domain.Name(), ".") {
+			continue
+		}
+		err = fs.walkDomain(domain.Name(), fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FileStore) walkDomain(domain string, fn func(domain, hash string, info Info) error) error {
+	dirs, err := os.ReadDir(path.Join(fs.root, domain))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(path.Join(fs.root, domain, dir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			fileInfo, err := file.Info()
+			if err != nil || file.IsDir() || strings.Contains(file.Name(), tempSuffix) {
+				continue
+			}
+			err = fn(domain, file.Name(), Info{Size: fileInfo.Size(), ModTime: fileInfo.ModTime()})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeEmptyDirs 删除域名下已经没有缓存的 hash 目录
+func (fs *FileStore) removeEmptyDirs(domain string) int {
+	dirs, err := os.ReadDir(path.Join(fs.root, domain))
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		//目录非空时 os.Remove 会失败
+		if os.Remove(path.Join(fs.root, domain, dir.Name())) == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// removeTempFiles 删除崩溃遗留的临时文件，正在写入的临时文件修改时间很近，不会被删除
+func (fs *FileStore) removeTempFiles(domain string) int {
+	dirs, err := os.ReadDir(path.Join(fs.root, domain))
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(path.Join(fs.root, domain, dir.Name()))
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if !strings.Contains(file.Name(), tempSuffix) {
+				continue
+			}
+			fileInfo, err := file.Info()
+			if err != nil || time.Since(fileInfo.ModTime()) < tempMaxAge {
+				continue
+			}
+			if os.Remove(path.Join(fs.root, domain, dir.Name(), file.Name())) == nil {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// quarantine 把损坏的缓存移到隔离目录，保留现场便于排查，同名的旧文件直接覆盖
+func (fs *FileStore) quarantine(domain, hash string) error {
+	dir := path.Join(fs.root, quarantineDir, domain)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path.Join(fs.root, domain, hash[:2], hash), path.Join(dir, hash))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (fs *FileStore) readHash(domain, hash string) ([]byte, error) {
+	return os.ReadFile(path.Join(fs.root, domain, hash[:2], hash))
+}
@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"encoding/gob"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFileStoreMigratesLegacy(t *testing.T) {
+	fs := NewFileStore(t.TempDir())
+	domain, key := "legacy.test", "/page"
+	filename := fs.filename(domain, key)
+	if err := os.MkdirAll(path.Dir(filename), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := legacyResponse{StatusCode: 200, Body: []byte("legacy body"), Header: http.Header{"Content-Type": {"text/html"}}, RandomHtml: "random"}
+	err = gob.NewEncoder(file).Encode(&legacy)
+	_ = file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	_ = os.Chtimes(filename, created, created)
+
+	for _, open := range []string{"Open", "Get"} {
+		var resp Response
+		if open == "Open" {
+			reader, err := fs.Open(domain, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Meta = reader.Meta
+			_ = reader.Close()
+		} else if err = fs.Get(domain, key, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 || resp.RandomHtml != "random" || resp.Header.Get("Content-Type") != "text/html" || !resp.Created.Equal(created) {
+			t.Fatalf("%s 读到的旧缓存不一致:%+v", open, resp.Meta)
+		}
+	}
+	//读取后已转存为新格式，修改时间不变
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := new(Response)
+	isLegacy, err := decodeBytes(data, resp)
+	if err != nil || isLegacy || string(resp.Body) != "legacy body" {
+		t.Fatalf("没有转存为新格式 legacy=%t:%v", isLegacy, err)
+	}
+	if info, _ := os.Stat(filename); !info.ModTime().Equal(created) {
+		t.Fatalf("转存后修改时间为 %s，应为 %s", info.ModTime(), created)
+	}
+}
+
+func TestFileStoreCorrupted(t *testing.T) {
+	fs := NewFileStore(t.TempDir())
+	domain, key := "corrupt.test", "/page"
+	if err := fs.Put(domain, key, &Response{Meta: Meta{StatusCode: 200}, Body: []byte("body")}); err != nil {
+		t.Fatal(err)
+	}
+	filename := fs.filename(domain, key)
+	data, _ := os.ReadFile(filename)
+	//截断的文件打开时就能发现，修改过的正文读取时校验失败
+	if err := os.WriteFile(filename, data[:len(data)-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open(domain, key); !IsCorrupt(err) {
+		t.Fatalf("打开截断的缓存返回 %v", err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Get(domain, key, new(Response)); !IsCorrupt(err) {
+		t.Fatalf("读取正文被修改的缓存返回 %v", err)
+	}
+	hash := hashKey(key)
+	if err := fs.quarantine(domain, hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open(domain, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("隔离后打开返回 %v", err)
+	}
+	if _, err := os.Stat(path.Join(fs.root, quarantineDir, domain, hash)); err != nil {
+		t.Fatalf("隔离目录中没有文件:%v", err)
+	}
+}
@@ -0,0 +1,211 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"time"
+)
+
+// 缓存文件格式:
+//
+//	magic(4) | version(2) | header 长度(4) | header(json) | body
+//
+// header 中记录 body 的长度和校验值，读取时可以只解析 header，body 直接从文件流式输出
+const (
+	formatMagic   = "MRC\x00"
+	formatVersion = 1
+	prefixSize    = 10
+	//缓存头只有头信息，超过这个长度的一定是损坏的数据
+	maxHeaderSize = 1 << 20
+)
+
+var (
+	ErrChecksum = errors.New("缓存校验失败")
+	//ErrCorrupt 缓存数据不完整或无法解析，读取方当作不存在处理，重新回源
+	ErrCorrupt = errors.New("缓存已损坏")
+)
+
+// IsCorrupt 是否为缓存损坏导致的错误，损坏的缓存应当隔离
+func IsCorrupt(err error) bool {
+	return errors.Is(err, ErrCorrupt) || errors.Is(err, ErrChecksum)
+}
+
+func corrupt(err error) error {
+	if err == nil || IsCorrupt(err) {
+		return err
+	}
+	return errors.Join(ErrCorrupt, err)
+}
+
+// legacyResponse 旧版本 gob 编码的缓存结构
+type legacyResponse struct {
+	StatusCode int
+	Body       []byte
+	Header     http.Header
+	RandomHtml string
+}
+
+// Encode 按当前版本格式写出缓存，Size 和 Checksum 需要和 Body 一致
+func Encode(w io.Writer, resp *Response) error {
+	return encodeStream(w, &resp.Meta, bytes.NewReader(resp.Body))
+}
+
+// encodeStream 正文从 body 读取，用于正文在临时文件中的流式写入
+func encodeStream(w io.Writer, meta *Meta, body io.Reader) error {
+	header, err := encodeHeader(meta, 0)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	_, _ = bw.Write(header)
+	_, err = io.Copy(bw, body)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// encodeHeader 返回前缀和缓存头，缓存头不足 padTo 字节时用空格补齐，JSON 末尾的空白不影响解析
+func encodeHeader(meta *Meta, padTo int) ([]byte, error) {
+	header, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) < padTo {
+		header = append(header, bytes.Repeat([]byte(" "), padTo-len(header))...)
+	}
+	data := make([]byte, prefixSize, prefixSize+len(header))
+	copy(data, formatMagic)
+	binary.BigEndian.PutUint16(data[4:], formatVersion)
+	binary.BigEndian.PutUint32(data[6:], uint32(len(header)))
+	return append(data, header...), nil
+}
+
+// decodeMeta 读取缓存头，返回 body 在数据中的偏移。不是当前格式的数据返回 legacy=true。
+// size 为数据的总长度，未知时传 -1
+func decodeMeta(r io.Reader, size int64, meta *Meta) (offset int64, legacy bool, err error) {
+	prefix := make([]byte, prefixSize)
+	n, err := io.ReadFull(r, prefix)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, false, err
+	}
+	if n < len(formatMagic) || string(prefix[:len(formatMagic)]) != formatMagic {
+		return 0, true, nil
+	}
+	if n < prefixSize {
+		return 0, false, io.ErrUnexpectedEOF
+	}
+	version := binary.BigEndian.Uint16(prefix[4:])
+	switch version {
+	case formatVersion:
+	default:
+		return 0, false, fmt.Errorf("不支持的缓存版本:%d", version)
+	}
+	headerLen := binary.BigEndian.Uint32(prefix[6:])
+	if headerLen > maxHeaderSize || (size >= 0 && int64(headerLen) > size-prefixSize) {
+		return 0, false, fmt.Errorf("%w:缓存头长度 %d 超出范围", ErrCorrupt, headerLen)
+	}
+	header := make([]byte, headerLen)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return 0, false, err
+	}
+	err = json.Unmarshal(header, meta)
+	if err != nil {
+		return 0, false, err
+	}
+	return prefixSize + int64(headerLen), false, nil
+}
+
+// decodeLegacy 解析旧版 gob 缓存
+func decodeLegacy(r io.Reader, resp *Response) error {
+	var legacy legacyResponse
+	err := gob.NewDecoder(r).Decode(&legacy)
+	if err != nil {
+		return err
+	}
+	resp.StatusCode = legacy.StatusCode
+	resp.Header = legacy.Header
+	resp.RandomHtml = legacy.RandomHtml
+	resp.Body = append(resp.Body[:0], legacy.Body...)
+	resp.Size = int64(len(resp.Body))
+	resp.Checksum = crc32.ChecksumIEEE(resp.Body)
+	return nil
+}
+
+// decodeBytes 从完整的数据中解析缓存，兼容旧格式
+func decodeBytes(data []byte, resp *Response) (legacy bool, err error) {
+	offset, legacy, err := decodeMeta(bytes.NewReader(data), int64(len(data)), &resp.Meta)
+	if err != nil {
+		return false, err
+	}
+	if legacy {
+		return true, decodeLegacy(bytes.NewReader(data), resp)
+	}
+	body := data[offset:]
+	if int64(len(body)) != resp.Size || crc32.ChecksumIEEE(body) != resp.Checksum {
+		return false, ErrChecksum
+	}
+	resp.Body = append(resp.Body[:0], body...)
+	return false, nil
+}
+
+// Reader 打开的缓存，Body 只包含正文部分，可直接流式输出
+type Reader struct {
+	Meta
+	Body   io.ReadSeeker
+	closer io.Closer
+}
+
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// ReadAll 读取全部正文到 buffer 并校验，压缩保存的正文解压后写入
+func (r *Reader) ReadAll(buffer *bytes.Buffer) error {
+	if r.Encoding != "" {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		if int64(len(body)) != r.Size || crc32.ChecksumIEEE(body) != r.Checksum {
+			return ErrChecksum
+		}
+		decoded, err := decode(bytes.NewReader(body), r.Encoding)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(buffer, decoded)
+		return err
+	}
+	start := buffer.Len()
+	_, err := io.Copy(buffer, r.Body)
+	if err != nil {
+		return err
+	}
+	body := buffer.Bytes()[start:]
+	if int64(len(body)) != r.Size || crc32.ChecksumIEEE(body) != r.Checksum {
+		return ErrChecksum
+	}
+	return nil
+}
+
+func prepare(key string, resp *Response) {
+	resp.Key = key
+	if resp.Created.IsZero() {
+		resp.Created = time.Now()
+	}
+	resp.Size = int64(len(resp.Body))
+	resp.Checksum = crc32.ChecksumIEEE(resp.Body)
+}
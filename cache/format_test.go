@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func encodeTest(t *testing.T, body string) []byte {
+	t.Helper()
+	resp := &Response{Meta: Meta{StatusCode: 200, Header: http.Header{"Content-Type": {"text/plain"}}}, Body: []byte(body)}
+	prepare("/page", resp)
+	var buf bytes.Buffer
+	if err := Encode(&buf, resp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	for _, body := range []string{"", "body", string(bytes.Repeat([]byte("0123456789"), 1000))} {
+		resp := new(Response)
+		legacy, err := decodeBytes(encodeTest(t, body), resp)
+		if err != nil || legacy {
+			t.Fatalf("解析失败 legacy=%t:%v", legacy, err)
+		}
+		if string(resp.Body) != body || resp.Key != "/page" || resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/plain" {
+			t.Fatalf("解析结果和写入的不一致:%+v", resp.Meta)
+		}
+	}
+}
+
+func TestFormatCorrupted(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(data []byte) []byte
+		want   error
+	}{
+		{"正文被修改", func(data []byte) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		}, ErrChecksum},
+		{"正文被截断", func(data []byte) []byte {
+			return data[:len(data)-1]
+		}, ErrChecksum},
+		{"缓存头长度超出数据", func(data []byte) []byte {
+			binary.BigEndian.PutUint32(data[6:], uint32(len(data)))
+			return data
+		}, ErrCorrupt},
+		{"缓存头长度超过上限", func(data []byte) []byte {
+			binary.BigEndian.PutUint32(data[6:], maxHeaderSize+1)
+			return data
+		}, ErrCorrupt},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := decodeBytes(c.modify(encodeTest(t, "body")), new(Response))
+			if !errors.Is(err, c.want) || !IsCorrupt(corrupt(err)) {
+				t.Fatalf("错误为 %v，应为 %v", err, c.want)
+			}
+		})
+	}
+}
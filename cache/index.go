@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Entry 缓存索引中的一条记录，旧格式的缓存没有 Key，只能按 Hash 删除
+type Entry struct {
+	Key         string    `json:"key"`
+	Hash        string    `json:"hash"`
+	Size        int64     `json:"size"`
+	StatusCode  int       `json:"status_code"`
+	ContentType string    `json:"content_type"`
+	Variant     string    `json:"variant"`
+	Marker      bool      `json:"marker"`
+	Created     time.Time `json:"created"`
+	Accessed    time.Time `json:"accessed"`
+}
+
+// BaseKey 去掉变体后缀的缓存键，变体和它的标记有相同的 BaseKey
+func (e *Entry) BaseKey() string {
+	key, _, _ := strings.Cut(e.Key, "#")
+	return key
+}
+
+// indexer 可以列出和按条删除缓存的存储
+type indexer interface {
+	entries(domain string) []Entry
+	deleteEntry(domain string, entry Entry) error
+}
+
+// Entries 返回域名下的所有缓存，最近访问的在前。不支持索引的存储返回 nil
+func Entries(store Store, domain string) []Entry {
+	if idx, ok := store.(indexer); ok {
+		return idx.entries(domain)
+	}
+	return nil
+}
+
+// DeleteEntries 删除 Entries 返回的缓存，返回删除的数量
+func DeleteEntries(store Store, domain string, entries []Entry) (int, error) {
+	idx, ok := store.(indexer)
+	if !ok {
+		return 0, errors.New("该缓存类型不支持按条删除")
+	}
+	count := 0
+	for _, entry := range entries {
+		err := idx.deleteEntry(domain, entry)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func metaEntry(meta *Meta) Entry {
+	return Entry{
+		Key:         meta.Key,
+		StatusCode:  meta.StatusCode,
+		ContentType: meta.Header.Get("Content-Type"),
+		Variant:     meta.Variant,
+		Marker:      meta.IsMarker(),
+		Created:     meta.Created,
+	}
+}
+
+func (ts *trackedStore) entries(domain string) []Entry {
+	entries, missing := tracker.entries(ts, domain)
+	//启动时统计到的缓存还没有读取过头信息，列出时再补上
+	for _, i := range missing {
+		meta := new(Meta)
+		if ts.hashStore.readMeta(domain, entries[i].Hash, meta) != nil {
+			continue
+		}
+		entry := metaEntry(meta)
+		entry.Hash, entry.Size, entry.Accessed = entries[i].Hash, entries[i].Size, entries[i].Accessed
+		entries[i] = entry
+		tracker.setMeta(domain, entry.Hash, meta)
+	}
+	return entries
+}
+
+func (ts *trackedStore) deleteEntry(domain string, entry Entry) error {
+	tracker.remove(domain, entry.Hash)
+	return ts.deleteHash(domain, entry.Hash)
+}
+
+func (ms *MemoryStore) entries(domain string) []Entry {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entries := make([]Entry, 0)
+	for el := ms.ll.Front(); el != nil; el = el.Next() {
+		item := el.Value.(*memoryEntry)
+		if item.domain != domain {
+			continue
+		}
+		entry := metaEntry(&item.resp.Meta)
+		entry.Hash = item.hash
+		entry.Size = item.size
+		entry.Accessed = item.accessed
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (ms *MemoryStore) deleteEntry(domain string, entry Entry) error {
+	return ms.deleteHash(domain, entry.Hash)
+}
+
+func (fs *FileStore) readMeta(domain, hash string, meta *Meta) error {
+	file, err := os.Open(path.Join(fs.root, domain, hash[:2], hash))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	_, _, err = decodeMeta(file, fileInfo.Size(), meta)
+	return err
+}
+
+func (ss *SqliteStore) readMeta(domain, hash string, meta *Meta) error {
+	var data []byte
+	err := ss.db.QueryRow("select data from cache_entry where domain=? and hash=?", domain, hash).Scan(&data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	_, _, err = decodeMeta(bytes.NewReader(data), int64(len(data)), meta)
+	return err
+}
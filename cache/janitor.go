@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"errors"
+	"log/slog"
+	"seo/mirror/config"
+	"time"
+)
+
+var errJanitorStopped = errors.New("janitor stopped")
+
+// janitorMaxRate 每秒检查数的上限，限速的间隔不能小于 1 纳秒
+const janitorMaxRate = 10000
+
+// Janitor 定时遍历各站点缓存，删除超过缓存时间加宽限期的缓存
+type Janitor struct {
+	interval time.Duration
+	grace    time.Duration
+	rate     int
+	expiry   func() map[string]Expiry
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Expiry 站点的缓存时间范围，TTL 按缓存内容计算单条缓存的时间，为 nil 时都使用 Max。
+// Grace 为站点过期后仍会使用旧缓存的时间，和全局的宽限期取较长的
+type Expiry struct {
+	Min   time.Duration
+	Max   time.Duration
+	TTL   func(meta *Meta) time.Duration
+	Grace time.Duration
+}
+
+// StartJanitor expiry 返回每个站点的缓存时间
+func StartJanitor(expiry func() map[string]Expiry) *Janitor {
+	j := &Janitor{
+		interval: time.Duration(config.Conf.JanitorInterval) * time.Minute,
+		grace:    time.Duration(config.Conf.JanitorGrace) * time.Hour,
+		rate:     config.Conf.JanitorRate,
+		expiry:   expiry,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if j.interval <= 0 {
+		j.interval = time.Hour
+	}
+	if j.rate <= 0 {
+		j.rate = 200
+	}
+	if j.rate > janitorMaxRate {
+		slog.Warn("janitor_rate 超过上限，按上限清理", "rate", j.rate, "max", janitorMaxRate)
+		j.rate = janitorMaxRate
+	}
+	go j.run()
+	return j
+}
+
+func (j *Janitor) run() {
+	defer close(j.done)
+	timer := time.NewTimer(j.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-timer.C:
+		}
+		err := j.clean()
+		if errors.Is(err, errJanitorStopped) {
+			return
+		}
+		if err != nil {
+			slog.Error("清理过期缓存错误", "message", err.Error())
+		}
+		timer.Reset(j.interval)
+	}
+}
+
+func (j *Janitor) Stop() {
+	close(j.stop)
+	<-j.done
+}
+
+func (j *Janitor) clean() error {
+	//限制每秒检查的缓存数量，避免清理时占满磁盘 IO
+	limiter := time.NewTicker(time.Second / time.Duration(j.rate))
+	defer limiter.Stop()
+	for domain, expiry := range j.expiry() {
+		for _, store := range hashStores() {
+			start := time.Now()
+			count := 0
+			var size int64
+			//比最短的缓存时间新的不用检查，比最长的旧的直接删除，中间的读取缓存头按规则判断
+			grace := max(j.grace, expiry.Grace)
+			fresh := time.Now().Add(-expiry.Min - grace)
+			deadline := time.Now().Add(-expiry.Max - grace)
+			if expiry.TTL == nil {
+				fresh = deadline
+			}
+			meta := new(Meta)
+			err := store.walkDomain(domain, func(domain, hash string, info Info) error {
+				select {
+				case <-j.stop:
+					return errJanitorStopped
+				case <-limiter.C:
+				}
+				if info.ModTime.After(fresh) {
+					return nil
+				}
+				if info.ModTime.After(deadline) {
+					*meta = Meta{}
+					if store.readMeta(domain, hash, meta) != nil || time.Since(meta.Created) < expiry.TTL(meta)+grace {
+						return nil
+					}
+				}
+				err := store.deleteHash(domain, hash)
+				if err != nil {
+					slog.Error("删除过期缓存失败", "domain", domain, "hash", hash, "message", err.Error())
+					return nil
+				}
+				tracker.remove(domain, hash)
+				count++
+				size += info.Size
+				return nil
+			})
+			dirs, temps := 0, 0
+			if fs, ok := store.hashStore.(*FileStore); ok {
+				temps = fs.removeTempFiles(domain)
+				dirs = fs.removeEmptyDirs(domain)
+			}
+			if count > 0 || dirs > 0 || temps > 0 {
+				slog.Info("清理过期缓存", "domain", domain, "count", count, "size", size, "dirs", dirs, "temps", temps, "cost", time.Since(start).String())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestJanitorGrace(t *testing.T) {
+	cases := []struct {
+		name      string
+		grace     time.Duration
+		siteGrace time.Duration
+		kept      bool
+	}{
+		{"超过缓存时间加宽限期的删除", 0, 0, false},
+		{"全局宽限期内保留", 3 * time.Hour, 0, true},
+		{"站点的宽限期更长时按站点的保留", 0, 3 * time.Hour, true},
+		{"都过了宽限期的删除", 30 * time.Minute, 10 * time.Minute, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fs := NewFileStore(t.TempDir())
+			ts := &trackedStore{hashStore: fs}
+			storesMu.Lock()
+			stores["janitor-test"] = ts
+			storesMu.Unlock()
+			defer func() {
+				storesMu.Lock()
+				delete(stores, "janitor-test")
+				storesMu.Unlock()
+			}()
+			domain, key := "janitor.test", "/page"
+			created := time.Now().Add(-2 * time.Hour)
+			if err := ts.Put(domain, key, &Response{Meta: Meta{StatusCode: 200, Created: created}, Body: []byte("body")}); err != nil {
+				t.Fatal(err)
+			}
+			_ = os.Chtimes(fs.filename(domain, key), created, created)
+			j := &Janitor{
+				grace: c.grace,
+				rate:  janitorMaxRate,
+				expiry: func() map[string]Expiry {
+					return map[string]Expiry{domain: {Min: time.Hour, Max: time.Hour, Grace: c.siteGrace}}
+				},
+				stop: make(chan struct{}),
+			}
+			if err := j.clean(); err != nil {
+				t.Fatal(err)
+			}
+			_, err := ts.Stat(domain, key)
+			if kept := !errors.Is(err, ErrNotFound); kept != c.kept {
+				t.Fatalf("缓存保留为 %t，应为 %t", kept, c.kept)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	domain   string
+	key      string
+	hash     string
+	resp     Response
+	size     int64
+	accessed time.Time
+}
+
+// MemoryStore 按字节数限制容量的 LRU 内存缓存
+type MemoryStore struct {
+	mu       sync.Mutex
+	maxBytes int64
+	used     int64
+	ll       *list.List
+	items    map[string]*list.Element
+	//按 hash 查找，磁盘层按 hash 淘汰、清理时同步删除内存层
+	hashes map[string]*list.Element
+}
+
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{maxBytes: maxBytes, ll: list.New(), items: make(map[string]*list.Element), hashes: make(map[string]*list.Element)}
+}
+
+func memoryKey(domain, key string) string {
+	return domain + "\x00" + key
+}
+
+func entrySize(resp *Response) int64 {
+	size := int64(len(resp.Body) + len(resp.RandomHtml))
+	for k, values := range resp.Header {
+		size += int64(len(k))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	return size
+}
+
+func (ms *MemoryStore) Get(domain, key string, resp *Response) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	el, ok := ms.items[memoryKey(domain, key)]
+	if !ok {
+		return ErrNotFound
+	}
+	ms.ll.MoveToFront(el)
+	entry := el.Value.(*memoryEntry)
+	entry.accessed = time.Now()
+	resp.Meta = entry.resp.Meta
+	resp.Header = entry.resp.Header.Clone()
+	resp.Body = append(resp.Body[:0], entry.resp.Body...)
+	return nil
+}
+
+// Open 正文在写入后不会再修改，可以直接共享
+func (ms *MemoryStore) Open(domain, key string) (*Reader, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	el, ok := ms.items[memoryKey(domain, key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	ms.ll.MoveToFront(el)
+	entry := el.Value.(*memoryEntry)
+	entry.accessed = time.Now()
+	meta := entry.resp.Meta
+	meta.Header = meta.Header.Clone()
+	return &Reader{Meta: meta, Body: bytes.NewReader(entry.resp.Body)}, nil
+}
+
+func (ms *MemoryStore) Put(domain, key string, resp *Response) error {
+	prepare(key, resp)
+	entry := &memoryEntry{
+		domain:   domain,
+		key:      key,
+		hash:     hashKey(key),
+		resp:     Response{Meta: resp.Meta, Body: append([]byte(nil), resp.Body...)},
+		size:     entrySize(resp),
+		accessed: time.Now(),
+	}
+	entry.resp.Header = resp.Header.Clone()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	mk := memoryKey(domain, key)
+	if el, ok := ms.items[mk]; ok {
+		ms.removeElement(el)
+	}
+	//放不下时不缓存，旧内容已经删除，不会继续输出
+	if entry.size > ms.maxBytes {
+		return nil
+	}
+	el := ms.ll.PushFront(entry)
+	ms.items[mk] = el
+	ms.hashes[memoryKey(domain, entry.hash)] = el
+	ms.used += entry.size
+	for ms.used > ms.maxBytes {
+		ms.removeElement(ms.ll.Back())
+	}
+	return nil
+}
+
+func (ms *MemoryStore) removeElement(el *list.Element) {
+	entry := el.Value.(*memoryEntry)
+	ms.ll.Remove(el)
+	delete(ms.items, memoryKey(entry.domain, entry.key))
+	delete(ms.hashes, memoryKey(entry.domain, entry.hash))
+	ms.used -= entry.size
+}
+
+// deleteHash 按 hash 删除，没有原始键的旧格式缓存也能删除
+func (ms *MemoryStore) deleteHash(domain, hash string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if el, ok := ms.hashes[memoryKey(domain, hash)]; ok {
+		ms.removeElement(el)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Delete(domain, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if el, ok := ms.items[memoryKey(domain, key)]; ok {
+		ms.removeElement(el)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) PurgeDomain(domain string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	prefix := domain + "\x00"
+	for mk, el := range ms.items {
+		if strings.HasPrefix(mk, prefix) {
+			ms.removeElement(el)
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Stat(domain, key string) (Info, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	el, ok := ms.items[memoryKey(domain, key)]
+	if !ok {
+		return Info{}, ErrNotFound
+	}
+	entry := el.Value.(*memoryEntry)
+	return Info{Size: entry.size, ModTime: entry.resp.Created}, nil
+}
+
+// Usage 返回已用字节数、容量和缓存条数
+func (ms *MemoryStore) Usage() (used, max int64, count int) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.used, ms.maxBytes, len(ms.items)
+}
@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	cases := []struct {
+		name  string
+		sizes []int
+		//最后还能读到的写入序号
+		kept []int
+	}{
+		{"容量内全部保留", []int{10, 10, 10}, []int{0, 1, 2}},
+		{"超出容量淘汰最久未用的", []int{40, 40, 40}, []int{1, 2}},
+		{"超过容量的不缓存", []int{10, 200}, []int{0}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ms := NewMemoryStore(100)
+			for i, size := range c.sizes {
+				_ = ms.Put("a.test", string(rune('a'+i)), &Response{Body: []byte(strings.Repeat("x", size))})
+			}
+			for i := range c.sizes {
+				_, err := ms.Open("a.test", string(rune('a'+i)))
+				kept := err == nil
+				want := false
+				for _, k := range c.kept {
+					want = want || k == i
+				}
+				if kept != want {
+					t.Errorf("第 %d 个缓存保留为 %t，应为 %t", i, kept, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreOversizeReplacesOld(t *testing.T) {
+	ms := NewMemoryStore(100)
+	_ = ms.Put("a.test", "/page", &Response{Body: []byte("old")})
+	err := ms.Put("a.test", "/page", &Response{Body: []byte(strings.Repeat("x", 200))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ms.Open("a.test", "/page"); !errors.Is(err, ErrNotFound) {
+		t.Fatal("写入放不下的新内容后仍能读到旧内容")
+	}
+	if used, _, count := ms.Usage(); used != 0 || count != 0 {
+		t.Fatalf("用量 %d，条数 %d", used, count)
+	}
+}
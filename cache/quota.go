@@ -0,0 +1,404 @@
+package cache
+
+import (
+	"container/list"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// usageEntry 一个缓存的大小和最后访问时间，按 hash 记录，旧格式的缓存没有原始键也能统计。
+// meta 在写入缓存或后台列出时填充，启动时统计到的缓存为 nil。store 为外层的 trackedStore，淘汰时同步删除内存层
+type usageEntry struct {
+	domain   string
+	hash     string
+	size     int64
+	accessed time.Time
+	store    hashStore
+	meta     *Entry
+}
+
+type domainUsage struct {
+	limit int64
+	used  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+// hashStore 支持按 hash 删除和遍历的存储，淘汰和启动统计都依赖它
+type hashStore interface {
+	Store
+	deleteHash(domain, hash string) error
+	walk(fn func(domain, hash string, info Info) error) error
+	walkDomain(domain string, fn func(domain, hash string, info Info) error) error
+	readMeta(domain, hash string, meta *Meta) error
+	readHash(domain, hash string) ([]byte, error)
+}
+
+// Tracker 统计各域名的缓存用量，超出限额时由 Evictor 按 LRU 淘汰
+type Tracker struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	domains map[string]*domainUsage
+	notify  chan struct{}
+}
+
+var tracker = &Tracker{domains: make(map[string]*domainUsage), notify: make(chan struct{}, 1)}
+
+// SetLimit 设置全局缓存上限，单位字节，0 为不限制
+func SetLimit(limit int64) {
+	tracker.mu.Lock()
+	tracker.limit = limit
+	tracker.mu.Unlock()
+	tracker.wake()
+}
+
+// SetDomainLimit 设置单个域名的缓存上限，单位字节，0 为不限制
+func SetDomainLimit(domain string, limit int64) {
+	tracker.mu.Lock()
+	tracker.domain(domain).limit = limit
+	tracker.mu.Unlock()
+	tracker.wake()
+}
+
+// DomainUsage 返回域名当前缓存用量，单位字节
+func DomainUsage(domain string) int64 {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if du, ok := tracker.domains[domain]; ok {
+		return du.used
+	}
+	return 0
+}
+
+func (t *Tracker) domain(domain string) *domainUsage {
+	du, ok := t.domains[domain]
+	if !ok {
+		du = &domainUsage{ll: list.New(), items: make(map[string]*list.Element)}
+		t.domains[domain] = du
+	}
+	return du
+}
+
+func (t *Tracker) wake() {
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (t *Tracker) add(store hashStore, domain, hash string, size int64, meta *Meta) {
+	t.mu.Lock()
+	du := t.domain(domain)
+	if el, ok := du.items[hash]; ok {
+		t.removeElement(du, el)
+	}
+	entry := &usageEntry{domain: domain, hash: hash, size: size, accessed: time.Now(), store: store}
+	if meta != nil {
+		index := metaEntry(meta)
+		entry.meta = &index
+	}
+	du.items[hash] = du.ll.PushFront(entry)
+	du.used += size
+	t.used += size
+	over := (du.limit > 0 && du.used > du.limit) || (t.limit > 0 && t.used > t.limit)
+	t.mu.Unlock()
+	if over {
+		t.wake()
+	}
+}
+
+// load 载入启动时统计到的缓存，entries 需按访问时间从新到旧排好序
+func (t *Tracker) load(entries []*usageEntry) {
+	t.mu.Lock()
+	for _, entry := range entries {
+		du := t.domain(entry.domain)
+		if _, ok := du.items[entry.hash]; ok {
+			continue
+		}
+		du.items[entry.hash] = du.ll.PushBack(entry)
+		du.used += entry.size
+		t.used += entry.size
+	}
+	t.mu.Unlock()
+	t.wake()
+}
+
+// entries 列出域名在某个存储中的缓存，missing 为还没有头信息的下标
+func (t *Tracker) entries(store hashStore, domain string) (entries []Entry, missing []int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	du, ok := t.domains[domain]
+	if !ok {
+		return nil, nil
+	}
+	entries = make([]Entry, 0, du.ll.Len())
+	for el := du.ll.Front(); el != nil; el = el.Next() {
+		usage := el.Value.(*usageEntry)
+		if usage.store != store {
+			continue
+		}
+		var entry Entry
+		if usage.meta != nil {
+			entry = *usage.meta
+		} else {
+			missing = append(missing, len(entries))
+		}
+		entry.Hash, entry.Size, entry.Accessed = usage.hash, usage.size, usage.accessed
+		entries = append(entries, entry)
+	}
+	return entries, missing
+}
+
+func (t *Tracker) setMeta(domain, hash string, meta *Meta) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if du, ok := t.domains[domain]; ok {
+		if el, ok := du.items[hash]; ok {
+			index := metaEntry(meta)
+			el.Value.(*usageEntry).meta = &index
+		}
+	}
+}
+
+func (t *Tracker) touch(domain, hash string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	du, ok := t.domains[domain]
+	if !ok {
+		return
+	}
+	if el, ok := du.items[hash]; ok {
+		el.Value.(*usageEntry).accessed = time.Now()
+		du.ll.MoveToFront(el)
+	}
+}
+
+func (t *Tracker) remove(domain, hash string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	du, ok := t.domains[domain]
+	if !ok {
+		return
+	}
+	if el, ok := du.items[hash]; ok {
+		t.removeElement(du, el)
+	}
+}
+
+func (t *Tracker) removeElement(du *domainUsage, el *list.Element) {
+	entry := el.Value.(*usageEntry)
+	du.ll.Remove(el)
+	delete(du.items, entry.hash)
+	du.used -= entry.size
+	t.used -= entry.size
+}
+
+func (t *Tracker) purge(domain string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	du, ok := t.domains[domain]
+	if !ok {
+		return
+	}
+	t.used -= du.used
+	du.used = 0
+	du.ll.Init()
+	du.items = make(map[string]*list.Element)
+}
+
+// victim 取出下一个需要淘汰的缓存，没有超限时返回 nil
+func (t *Tracker) victim() *usageEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var target *domainUsage
+	for _, du := range t.domains {
+		if du.limit > 0 && du.used > du.limit && du.ll.Len() > 0 {
+			target = du
+			break
+		}
+	}
+	if target == nil && t.limit > 0 && t.used > t.limit {
+		//全局超限时淘汰所有域名中最久未访问的
+		var oldest time.Time
+		for _, du := range t.domains {
+			back := du.ll.Back()
+			if back == nil {
+				continue
+			}
+			accessed := back.Value.(*usageEntry).accessed
+			if target == nil || accessed.Before(oldest) {
+				target = du
+				oldest = accessed
+			}
+		}
+	}
+	if target == nil {
+		return nil
+	}
+	el := target.ll.Back()
+	entry := el.Value.(*usageEntry)
+	t.removeElement(target, el)
+	return entry
+}
+
+func (t *Tracker) evict() {
+	count := 0
+	var size int64
+	for entry := t.victim(); entry != nil; entry = t.victim() {
+		err := entry.store.deleteHash(entry.domain, entry.hash)
+		if err != nil {
+			slog.Error("淘汰缓存失败", "domain", entry.domain, "hash", entry.hash, "message", err.Error())
+		}
+		count++
+		size += entry.size
+	}
+	if count > 0 {
+		slog.Info("缓存超限淘汰", "count", count, "size", size)
+	}
+}
+
+// trackedStore 在存储外层记录用量
+type trackedStore struct {
+	hashStore
+	//启动统计完成后关闭
+	scanned chan struct{}
+	//外层有分层存储时为内存层，按 hash 删除磁盘上的缓存时一起删除
+	hot *MemoryStore
+}
+
+// deleteHash 淘汰、清理、隔离都按 hash 删除，内存层不能继续输出已经删除的缓存
+func (ts *trackedStore) deleteHash(domain, hash string) error {
+	if ts.hot != nil {
+		_ = ts.hot.deleteHash(domain, hash)
+	}
+	return ts.hashStore.deleteHash(domain, hash)
+}
+
+func (ts *trackedStore) Get(domain, key string, resp *Response) error {
+	err := ts.hashStore.Get(domain, key, resp)
+	if err == nil {
+		tracker.touch(domain, hashKey(key))
+	} else if IsCorrupt(err) {
+		ts.quarantineKey(domain, key, err)
+	}
+	return err
+}
+
+func (ts *trackedStore) Open(domain, key string) (*Reader, error) {
+	reader, err := ts.hashStore.Open(domain, key)
+	if err == nil {
+		tracker.touch(domain, hashKey(key))
+	} else if IsCorrupt(err) {
+		ts.quarantineKey(domain, key, err)
+	}
+	return reader, err
+}
+
+// quarantineKey 读到损坏的缓存时隔离，下次请求当作不存在重新回源
+func (ts *trackedStore) quarantineKey(domain, key string, cause error) {
+	slog.Warn("缓存损坏，已隔离", "domain", domain, "key", key, "message", cause.Error())
+	err := ts.quarantine(domain, hashKey(key))
+	if err != nil {
+		slog.Error("隔离缓存失败", "domain", domain, "key", key, "message", err.Error())
+	}
+}
+
+// quarantine 支持隔离的存储移到隔离区，其他存储直接删除
+func (ts *trackedStore) quarantine(domain, hash string) error {
+	tracker.remove(domain, hash)
+	if ts.hot != nil {
+		_ = ts.hot.deleteHash(domain, hash)
+	}
+	if q, ok := ts.hashStore.(quarantiner); ok {
+		return q.quarantine(domain, hash)
+	}
+	return ts.hashStore.deleteHash(domain, hash)
+}
+
+func (ts *trackedStore) touch(domain, key string) {
+	tracker.touch(domain, hashKey(key))
+}
+
+func (ts *trackedStore) Put(domain, key string, resp *Response) error {
+	err := ts.hashStore.Put(domain, key, resp)
+	if err != nil {
+		return err
+	}
+	//按实际占用统计，和启动时遍历得到的大小一致
+	info, err := ts.hashStore.Stat(domain, key)
+	if err != nil {
+		return err
+	}
+	tracker.add(ts, domain, hashKey(key), info.Size, &resp.Meta)
+	return nil
+}
+
+func (ts *trackedStore) Delete(domain, key string) error {
+	tracker.remove(domain, hashKey(key))
+	return ts.hashStore.Delete(domain, key)
+}
+
+func (ts *trackedStore) PurgeDomain(domain string) error {
+	tracker.purge(domain)
+	return ts.hashStore.PurgeDomain(domain)
+}
+
+// scan 启动时统计存储中已有的缓存，以修改时间作为最后访问时间
+func (ts *trackedStore) scan() {
+	defer close(ts.scanned)
+	entries := make([]*usageEntry, 0)
+	err := ts.hashStore.walk(func(domain, hash string, info Info) error {
+		entries = append(entries, &usageEntry{domain: domain, hash: hash, size: info.Size, accessed: info.ModTime, store: ts})
+		return nil
+	})
+	if err != nil {
+		slog.Error("统计缓存用量失败", "message", err.Error())
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].accessed.After(entries[j].accessed)
+	})
+	tracker.load(entries)
+}
+
+// waitScan 等待启动统计完成，完成前索引中还没有存储里已有的缓存
+func waitScan(store Store) {
+	if tiered, ok := store.(*TieredStore); ok {
+		store = tiered.cold
+	}
+	if ts, ok := store.(*trackedStore); ok && ts.scanned != nil {
+		<-ts.scanned
+	}
+}
+
+// Evictor 后台淘汰协程
+type Evictor struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func StartEvictor() *Evictor {
+	e := &Evictor{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(e.done)
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-tracker.notify:
+			case <-ticker.C:
+			}
+			tracker.evict()
+		}
+	}()
+	return e
+}
+
+func (e *Evictor) Stop() {
+	close(e.stop)
+	<-e.done
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQuotaEvictsLeastRecentlyUsed(t *testing.T) {
+	type item struct{ domain, key string }
+	cases := []struct {
+		name    string
+		puts    []item
+		touched []item
+		global  bool
+		//上限能放下的缓存个数
+		limit   int
+		evicted []item
+	}{
+		{"域名超限淘汰最久未访问的", []item{{"a.test", "/1"}, {"a.test", "/2"}, {"a.test", "/3"}}, []item{{"a.test", "/1"}}, false, 2, []item{{"a.test", "/2"}}},
+		{"访问过的最后淘汰", []item{{"a.test", "/1"}, {"a.test", "/2"}, {"a.test", "/3"}}, []item{{"a.test", "/2"}, {"a.test", "/1"}}, false, 1, []item{{"a.test", "/3"}, {"a.test", "/2"}}},
+		{"只淘汰超限的域名", []item{{"a.test", "/1"}, {"b.test", "/1"}, {"a.test", "/2"}}, nil, false, 1, []item{{"a.test", "/1"}}},
+		{"全局超限淘汰所有域名中最久未访问的", []item{{"a.test", "/1"}, {"b.test", "/1"}, {"a.test", "/2"}}, []item{{"a.test", "/1"}}, true, 2, []item{{"b.test", "/1"}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			saved := tracker
+			tracker = &Tracker{domains: make(map[string]*domainUsage), notify: make(chan struct{}, 1)}
+			defer func() {
+				tracker = saved
+			}()
+			ts := &trackedStore{hashStore: NewFileStore(t.TempDir())}
+			for _, put := range c.puts {
+				if err := ts.Put(put.domain, put.key, &Response{Meta: Meta{StatusCode: 200}, Body: []byte("body")}); err != nil {
+					t.Fatal(err)
+				}
+				//全局淘汰按访问时间比较不同域名
+				time.Sleep(time.Millisecond)
+			}
+			for _, touched := range c.touched {
+				if err := ts.Get(touched.domain, touched.key, new(Response)); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			//缓存头中的时间长度不固定，各缓存的大小略有差别，上限多留半个
+			size := DomainUsage("a.test") / int64(len(ts.entries("a.test")))
+			limit := size*int64(c.limit) + size/2
+			if c.global {
+				SetLimit(limit)
+			} else {
+				SetDomainLimit("a.test", limit)
+			}
+			tracker.evict()
+			for _, put := range c.puts {
+				_, err := ts.Stat(put.domain, put.key)
+				evicted := false
+				for _, e := range c.evicted {
+					evicted = evicted || e == put
+				}
+				if got := errors.Is(err, ErrNotFound); got != evicted {
+					t.Errorf("%s%s 淘汰为 %t，应为 %t", put.domain, put.key, got, evicted)
+				}
+			}
+		})
+	}
+}
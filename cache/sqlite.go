@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"time"
+
+	_ "github.com/glebarez/go-sqlite"
+)
+
+// SqliteStore 所有缓存存放在一个 sqlite 文件中，适合小文件多、磁盘 inode 紧张的机器
+type SqliteStore struct {
+	db *sql.DB
+}
+
+func NewSqliteStore(filename string) (*SqliteStore, error) {
+	db, err := sql.Open("sqlite", filename)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`create table if not exists cache_entry (
+		domain varchar(50) not null,
+		hash char(40) not null,
+		data blob,
+		size integer,
+		mod_time integer,
+		primary key (domain, hash)
+)`)
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteStore{db: db}, nil
+}
+
+func (ss *SqliteStore) Get(domain, key string, resp *Response) error {
+	var data []byte
+	err := ss.db.QueryRow("select data from cache_entry where domain=? and hash=?", domain, hashKey(key)).Scan(&data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	legacy, err := decodeBytes(data, resp)
+	if err != nil {
+		return corrupt(err)
+	}
+	if legacy {
+		return ss.Put(domain, key, resp)
+	}
+	return nil
+}
+
+func (ss *SqliteStore) Open(domain, key string) (*Reader, error) {
+	resp := new(Response)
+	err := ss.Get(domain, key, resp)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{Meta: resp.Meta, Body: bytes.NewReader(resp.Body)}, nil
+}
+
+func (ss *SqliteStore) Put(domain, key string, resp *Response) error {
+	prepare(key, resp)
+	var buffer bytes.Buffer
+	err := Encode(&buffer, resp)
+	if err != nil {
+		return err
+	}
+	_, err = ss.db.Exec("replace into cache_entry(domain,hash,data,size,mod_time)values (?,?,?,?,?)",
+		domain, hashKey(key), buffer.Bytes(), buffer.Len(), resp.Created.Unix())
+	return err
+}
+
+func (ss *SqliteStore) Delete(domain, key string) error {
+	_, err := ss.db.Exec("delete from cache_entry where domain=? and hash=?", domain, hashKey(key))
+	return err
+}
+
+func (ss *SqliteStore) PurgeDomain(domain string) error {
+	_, err := ss.db.Exec("delete from cache_entry where domain=?", domain)
+	return err
+}
+
+func (ss *SqliteStore) Stat(domain, key string) (Info, error) {
+	var size, modTime int64
+	err := ss.db.QueryRow("select size,mod_time from cache_entry where domain=? and hash=?", domain, hashKey(key)).Scan(&size, &modTime)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Info{}, ErrNotFound
+		}
+		return Info{}, err
+	}
+	return Info{Size: size, ModTime: time.Unix(modTime, 0)}, nil
+}
+
+func (ss *SqliteStore) deleteHash(domain, hash string) error {
+	_, err := ss.db.Exec("delete from cache_entry where domain=? and hash=?", domain, hash)
+	return err
+}
+
+func (ss *SqliteStore) walk(fn func(domain, hash string, info Info) error) error {
+	return ss.query(fn, "select domain,hash,size,mod_time from cache_entry")
+}
+
+func (ss *SqliteStore) walkDomain(domain string, fn func(domain, hash string, info Info) error) error {
+	return ss.query(fn, "select domain,hash,size,mod_time from cache_entry where domain=?", domain)
+}
+
+// query 先读出全部记录再回调，回调中可以删除记录
+func (ss *SqliteStore) query(fn func(domain, hash string, info Info) error, querySql string, args ...any) error {
+	type row struct {
+		domain, hash string
+		info         Info
+	}
+	rs, err := ss.db.Query(querySql, args...)
+	if err != nil {
+		return err
+	}
+	rows := make([]row, 0)
+	for rs.Next() {
+		var r row
+		var size, modTime int64
+		err = rs.Scan(&r.domain, &r.hash, &size, &modTime)
+		if err != nil {
+			_ = rs.Close()
+			return err
+		}
+		r.info = Info{Size: size, ModTime: time.Unix(modTime, 0)}
+		rows = append(rows, r)
+	}
+	_ = rs.Close()
+	for _, r := range rows {
+		err = fn(r.domain, r.hash, r.info)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *SqliteStore) readHash(domain, hash string) ([]byte, error) {
+	var data []byte
+	err := ss.db.QueryRow("select data from cache_entry where domain=? and hash=?", domain, hash).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
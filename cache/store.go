@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"seo/mirror/config"
+	"sync"
+	"time"
+)
+
+const (
+	StoreFile   = "file"
+	StoreMemory = "memory"
+	StoreSqlite = "sqlite"
+)
+
+var ErrNotFound = errors.New("缓存不存在")
+
+// Meta 缓存头信息，Key 为原始缓存键
+type Meta struct {
+	Key        string      `json:"key"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	RandomHtml string      `json:"random_html"`
+	Created    time.Time   `json:"created"`
+	Expires    time.Time   `json:"expires"`
+	Size       int64       `json:"size"`
+	Checksum   uint32      `json:"checksum"`
+	//请求路径，不含参数，按路径匹配缓存规则时使用
+	Path string `json:"path,omitempty"`
+	//正文保存时使用的压缩方式，为空表示未压缩，Size 和 Checksum 都是压缩后的
+	Encoding string `json:"encoding,omitempty"`
+	//以下字段只在有变体时使用，Vary 和 Variants 记录在标记上，Variant 记录在变体上
+	Vary     []string `json:"vary,omitempty"`
+	Variants []string `json:"variants,omitempty"`
+	Variant  string   `json:"variant,omitempty"`
+}
+
+type Response struct {
+	Meta
+	Body []byte
+}
+
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Store 缓存存储，key 为原始缓存键，由各实现自行决定落盘方式
+type Store interface {
+	Get(domain, key string, resp *Response) error
+	Open(domain, key string) (*Reader, error)
+	Put(domain, key string, resp *Response) error
+	Delete(domain, key string) error
+	PurgeDomain(domain string) error
+	Stat(domain, key string) (Info, error)
+}
+
+var (
+	stores   = make(map[string]Store)
+	storesMu sync.Mutex
+)
+
+func Init() error {
+	SetLimit(config.Conf.CacheLimit << 20)
+	_, err := Open("")
+	return err
+}
+
+// Open 按名称返回缓存存储，同一种存储全局只创建一次，名称为空时使用全局配置
+func Open(name string) (Store, error) {
+	if name == "" {
+		name = config.Conf.CacheStore
+	}
+	if name == "" {
+		name = StoreFile
+	}
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	if s, ok := stores[name]; ok {
+		return s, nil
+	}
+	var s Store
+	var err error
+	switch name {
+	case StoreFile:
+		s = NewFileStore(config.Conf.CachePath)
+	case StoreMemory:
+		size := config.Conf.CacheMemorySize
+		if size <= 0 {
+			size = 256
+		}
+		s = NewMemoryStore(size << 20)
+	case StoreSqlite:
+		s, err = NewSqliteStore("config/cache.db")
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("未知的缓存类型:%s", name)
+	}
+	//内存缓存自身有容量限制，不参与限额统计
+	if hs, ok := s.(hashStore); ok {
+		ts := &trackedStore{hashStore: hs, scanned: make(chan struct{})}
+		go ts.scan()
+		s = ts
+		if config.Conf.CacheHotSize > 0 {
+			tiered := NewTieredStore(ts, config.Conf.CacheHotSize<<20)
+			ts.hot = tiered.hot
+			s = tiered
+		}
+	}
+	stores[name] = s
+	return s, nil
+}
+
+// hashStores 已打开的支持遍历的存储，通过外层删除时内存层同步删除
+func hashStores() []*trackedStore {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	result := make([]*trackedStore, 0, len(stores))
+	for _, s := range stores {
+		if tiered, ok := s.(*TieredStore); ok {
+			s = tiered.cold
+		}
+		if ts, ok := s.(*trackedStore); ok {
+			result = append(result, ts)
+		}
+	}
+	return result
+}
+
+func hashKey(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+	"sync/atomic"
+)
+
+// TieredStore 在磁盘存储前面加一层内存缓存，读取时先查内存，磁盘命中后放入内存，写入时两层同时写。
+// 内存层只放不超过容量 1/8 的缓存，避免一个大文件把常用的页面挤出去
+type TieredStore struct {
+	hot        *MemoryStore
+	cold       Store
+	maxEntry   int64
+	hotHits    atomic.Int64
+	hotMisses  atomic.Int64
+	coldHits   atomic.Int64
+	coldMisses atomic.Int64
+}
+
+// TierStats 各层的命中统计和内存层占用
+type TierStats struct {
+	HotHits    int64 `json:"hot_hits"`
+	HotMisses  int64 `json:"hot_misses"`
+	ColdHits   int64 `json:"cold_hits"`
+	ColdMisses int64 `json:"cold_misses"`
+	HotUsed    int64 `json:"hot_used"`
+	HotMax     int64 `json:"hot_max"`
+	HotEntries int   `json:"hot_entries"`
+}
+
+// toucher 内存层命中时通知磁盘层更新访问时间，让磁盘的 LRU 淘汰不误删热点缓存
+type toucher interface {
+	touch(domain, key string)
+}
+
+func NewTieredStore(cold Store, hotBytes int64) *TieredStore {
+	return &TieredStore{hot: NewMemoryStore(hotBytes), cold: cold, maxEntry: hotBytes / 8}
+}
+
+func (ts *TieredStore) Get(domain, key string, resp *Response) error {
+	if ts.hot.Get(domain, key, resp) == nil {
+		ts.hit(domain, key)
+		return nil
+	}
+	ts.hotMisses.Add(1)
+	err := ts.cold.Get(domain, key, resp)
+	if err != nil {
+		ts.coldMisses.Add(1)
+		return err
+	}
+	ts.coldHits.Add(1)
+	if resp.Size <= ts.maxEntry {
+		ts.promote(domain, key, resp)
+	}
+	return nil
+}
+
+// Open 磁盘命中且大小合适时读出全部正文校验后放入内存，否则直接返回磁盘的流
+func (ts *TieredStore) Open(domain, key string) (*Reader, error) {
+	if reader, err := ts.hot.Open(domain, key); err == nil {
+		ts.hit(domain, key)
+		return reader, nil
+	}
+	ts.hotMisses.Add(1)
+	reader, err := ts.cold.Open(domain, key)
+	if err != nil {
+		ts.coldMisses.Add(1)
+		return nil, err
+	}
+	ts.coldHits.Add(1)
+	if reader.Size > ts.maxEntry {
+		return reader, nil
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	body, err := io.ReadAll(reader.Body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) != reader.Size || crc32.ChecksumIEEE(body) != reader.Checksum {
+		_ = Quarantine(ts, domain, key)
+		return nil, ErrChecksum
+	}
+	resp := &Response{Meta: reader.Meta, Body: body}
+	ts.promote(domain, key, resp)
+	return &Reader{Meta: reader.Meta, Body: bytes.NewReader(body)}, nil
+}
+
+// Put 先写磁盘，磁盘写入成功后再写内存，保证内存中的缓存磁盘上一定有过
+func (ts *TieredStore) Put(domain, key string, resp *Response) error {
+	err := ts.cold.Put(domain, key, resp)
+	if err != nil {
+		_ = ts.hot.Delete(domain, key)
+		return err
+	}
+	if resp.Size > ts.maxEntry {
+		return ts.hot.Delete(domain, key)
+	}
+	return ts.hot.Put(domain, key, resp)
+}
+
+func (ts *TieredStore) Delete(domain, key string) error {
+	_ = ts.hot.Delete(domain, key)
+	return ts.cold.Delete(domain, key)
+}
+
+func (ts *TieredStore) PurgeDomain(domain string) error {
+	_ = ts.hot.PurgeDomain(domain)
+	return ts.cold.PurgeDomain(domain)
+}
+
+func (ts *TieredStore) Stat(domain, key string) (Info, error) {
+	return ts.cold.Stat(domain, key)
+}
+
+// Stats 返回命中统计
+func (ts *TieredStore) Stats() TierStats {
+	used, max, count := ts.hot.Usage()
+	return TierStats{
+		HotHits:    ts.hotHits.Load(),
+		HotMisses:  ts.hotMisses.Load(),
+		ColdHits:   ts.coldHits.Load(),
+		ColdMisses: ts.coldMisses.Load(),
+		HotUsed:    used,
+		HotMax:     max,
+		HotEntries: count,
+	}
+}
+
+func (ts *TieredStore) hit(domain, key string) {
+	ts.hotHits.Add(1)
+	if t, ok := ts.cold.(toucher); ok {
+		t.touch(domain, key)
+	}
+}
+
+// promote 放入内存层，Put 会重新计算 Key、Size 和 Checksum，传入副本避免修改调用方的数据
+func (ts *TieredStore) promote(domain, key string, resp *Response) {
+	promoted := *resp
+	_ = ts.hot.Put(domain, key, &promoted)
+}
+
+// entries 以磁盘为准，磁盘按 hash 删除时内存层同步删除，内存中多出的只有启动统计完成前读到的缓存，也一起列出
+func (ts *TieredStore) entries(domain string) []Entry {
+	var entries []Entry
+	if idx, ok := ts.cold.(indexer); ok {
+		entries = idx.entries(domain)
+	}
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		seen[entry.Hash] = true
+	}
+	for _, entry := range ts.hot.entries(domain) {
+		if !seen[entry.Hash] {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (ts *TieredStore) deleteEntry(domain string, entry Entry) error {
+	if entry.Key != "" {
+		_ = ts.hot.Delete(domain, entry.Key)
+	}
+	if idx, ok := ts.cold.(indexer); ok {
+		return idx.deleteEntry(domain, entry)
+	}
+	return nil
+}
+
+// Stats 所有分层存储的统计，按存储名称区分
+func Stats() map[string]TierStats {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	result := make(map[string]TierStats)
+	for name, s := range stores {
+		if ts, ok := s.(*TieredStore); ok {
+			result[name] = ts.Stats()
+		}
+	}
+	return result
+}
@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+)
+
+func newTestTiered(t *testing.T) (*TieredStore, *trackedStore) {
+	t.Helper()
+	ts := &trackedStore{hashStore: NewFileStore(t.TempDir())}
+	tiered := NewTieredStore(ts, 1<<20)
+	ts.hot = tiered.hot
+	return tiered, ts
+}
+
+func TestTieredDropsHotOnDiskDelete(t *testing.T) {
+	cases := []struct {
+		name   string
+		delete func(ts *trackedStore, domain, key string)
+	}{
+		{"淘汰", func(ts *trackedStore, domain, key string) {
+			SetDomainLimit(domain, 1)
+			defer SetDomainLimit(domain, 0)
+			tracker.evict()
+		}},
+		{"清理", func(ts *trackedStore, domain, key string) {
+			_ = ts.deleteHash(domain, hashKey(key))
+		}},
+		{"隔离", func(ts *trackedStore, domain, key string) {
+			_ = ts.quarantine(domain, hashKey(key))
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tiered, ts := newTestTiered(t)
+			domain, key := "tiered-"+c.name+".test", "/page"
+			err := tiered.Put(domain, key, &Response{Meta: Meta{StatusCode: 200}, Body: []byte("body")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = tiered.hot.Open(domain, key); err != nil {
+				t.Fatal("写入后内存层应有缓存")
+			}
+			c.delete(ts, domain, key)
+			if _, err = tiered.Open(domain, key); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("磁盘删除后仍能读到缓存:%v", err)
+			}
+		})
+	}
+}
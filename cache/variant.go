@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 同一个地址有多个变体时，原始键上保存标记，记录区分变体的字段和所有变体的键，
+// 变体的内容保存在 VariantKey 生成的键上
+var variantMu sync.Mutex
+
+// maxVariants 一个地址最多保存的变体数，超过后新的变体不再缓存，避免取值很多的字段无限增加变体
+const maxVariants = 32
+
+var ErrTooManyVariants = errors.New("变体数量超过上限")
+
+// IsMarker 是否为记录变体信息的标记，标记本身没有内容
+func (m *Meta) IsMarker() bool {
+	return len(m.Vary) > 0
+}
+
+// VariantKey variant 为请求在各个字段上的取值
+func VariantKey(key, variant string) string {
+	sum := sha1.Sum([]byte(variant))
+	return key + "#" + hex.EncodeToString(sum[:6])
+}
+
+// NegativeKey 源站返回 404、5xx 等错误时单独保存的键，不覆盖原始键上的正常缓存
+func NegativeKey(key string) string {
+	return key + "#negative"
+}
+
+// PutVariant 写入一个变体，并把它记录到原始键的标记上。区分字段变化时删除旧的变体
+func PutVariant(store Store, domain, key string, vary []string, variant string, resp *Response) error {
+	variantKey := VariantKey(key, variant)
+	resp.Variant = variant
+	err := store.Put(domain, variantKey, resp)
+	if err != nil {
+		return err
+	}
+	return markVariant(store, domain, key, vary, variantKey)
+}
+
+// markVariant 把已经写入的变体记录到原始键的标记上
+func markVariant(store Store, domain, key string, vary []string, variantKey string) error {
+	variantMu.Lock()
+	defer variantMu.Unlock()
+	marker := new(Response)
+	err := store.Get(domain, key, marker)
+	if err != nil || !marker.IsMarker() || !slices.Equal(marker.Vary, vary) {
+		for _, old := range marker.Variants {
+			if old != variantKey {
+				_ = store.Delete(domain, old)
+			}
+		}
+		marker = &Response{Meta: Meta{Vary: vary}}
+	}
+	if !slices.Contains(marker.Variants, variantKey) {
+		if len(marker.Variants) >= maxVariants {
+			_ = store.Delete(domain, variantKey)
+			return ErrTooManyVariants
+		}
+		marker.Variants = append(slices.Clip(marker.Variants), variantKey)
+	}
+	//标记跟着最新的变体更新时间，避免先于变体被清理
+	marker.Created = time.Now()
+	marker.Body = nil
+	return store.Put(domain, key, marker)
+}
+
+// Purge 删除一个缓存键，有变体和错误缓存时一起删除
+func Purge(store Store, domain, key string) error {
+	variantMu.Lock()
+	defer variantMu.Unlock()
+	marker := new(Response)
+	if err := store.Get(domain, key, marker); err == nil {
+		for _, variantKey := range marker.Variants {
+			err = store.Delete(domain, variantKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := store.Delete(domain, NegativeKey(key))
+	if err != nil {
+		return err
+	}
+	return store.Delete(domain, key)
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestPutVariant(t *testing.T) {
+	type put struct {
+		vary    []string
+		variant string
+	}
+	cases := []struct {
+		name string
+		puts []put
+		//标记上最后记录的变体
+		variants []string
+		//已经删除的变体
+		deleted []string
+	}{
+		{"同一字段的变体都保留", []put{{[]string{"Accept-Language"}, "zh"}, {[]string{"Accept-Language"}, "en"}, {[]string{"Accept-Language"}, "zh"}}, []string{"zh", "en"}, nil},
+		{"区分字段变化时删除旧的变体", []put{{[]string{"Accept-Language"}, "zh"}, {[]string{"Accept-Language"}, "en"}, {[]string{"Cookie"}, "a=1"}}, []string{"a=1"}, []string{"zh", "en"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store := NewMemoryStore(1 << 20)
+			for _, p := range c.puts {
+				if err := PutVariant(store, "a.test", "/page", p.vary, p.variant, &Response{Body: []byte(p.variant)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			marker := new(Response)
+			if err := store.Get("a.test", "/page", marker); err != nil || !marker.IsMarker() {
+				t.Fatalf("没有写入标记:%v", err)
+			}
+			want := make([]string, len(c.variants))
+			for i, variant := range c.variants {
+				want[i] = VariantKey("/page", variant)
+			}
+			if !slices.Equal(marker.Variants, want) {
+				t.Fatalf("标记上的变体为 %v，应为 %v", marker.Variants, want)
+			}
+			for _, variant := range c.deleted {
+				if _, err := store.Stat("a.test", VariantKey("/page", variant)); !errors.Is(err, ErrNotFound) {
+					t.Errorf("变体 %s 没有删除", variant)
+				}
+			}
+		})
+	}
+}
+
+func TestPutVariantLimit(t *testing.T) {
+	store := NewMemoryStore(1 << 20)
+	vary := []string{"Accept-Language"}
+	for i := 0; i < maxVariants; i++ {
+		if err := PutVariant(store, "a.test", "/page", vary, strconv.Itoa(i), &Response{Body: []byte("body")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := PutVariant(store, "a.test", "/page", vary, "new", &Response{Body: []byte("body")})
+	if !errors.Is(err, ErrTooManyVariants) {
+		t.Fatalf("超过上限时返回 %v", err)
+	}
+	if _, err = store.Stat("a.test", VariantKey("/page", "new")); !errors.Is(err, ErrNotFound) {
+		t.Fatal("超过上限的变体没有删除")
+	}
+	//已有的变体仍然可以更新
+	if err = PutVariant(store, "a.test", "/page", vary, "0", &Response{Body: []byte("new body")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = Purge(store, "a.test", "/page"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, count := store.Usage(); count != 0 {
+		t.Fatalf("删除后还剩 %d 条缓存", count)
+	}
+}
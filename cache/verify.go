@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// quarantiner 可以把损坏的缓存移出正常目录的存储
+type quarantiner interface {
+	quarantine(domain, hash string) error
+}
+
+// Quarantine 隔离一条损坏的缓存，读取正文时才发现校验失败的由调用方隔离
+func Quarantine(store Store, domain, key string) error {
+	if tiered, ok := store.(*TieredStore); ok {
+		_ = tiered.hot.Delete(domain, key)
+		store = tiered.cold
+	}
+	if q, ok := store.(quarantiner); ok {
+		return q.quarantine(domain, hashKey(key))
+	}
+	return store.Delete(domain, key)
+}
+
+// VerifyResult 校验的统计，Bad 中记录损坏缓存所在的域名、hash 和原因
+type VerifyResult struct {
+	Checked int
+	Bad     []VerifyError
+	Removed int
+}
+
+type VerifyError struct {
+	Domain string
+	Hash   string
+	Err    error
+}
+
+// Verify 逐条读取已打开的磁盘存储中的缓存，校验格式、校验值和缓存键。
+// domain 为空时检查全部域名，remove 为 true 时隔离损坏的缓存
+func Verify(domain string, remove bool) (*VerifyResult, error) {
+	result := new(VerifyResult)
+	for _, store := range hashStores() {
+		check := func(domain, hash string, info Info) error {
+			result.Checked++
+			err := verifyHash(store, domain, hash)
+			if err == nil {
+				return nil
+			}
+			result.Bad = append(result.Bad, VerifyError{Domain: domain, Hash: hash, Err: err})
+			if !remove {
+				return nil
+			}
+			err = store.quarantine(domain, hash)
+			if err != nil {
+				slog.Error("隔离缓存失败", "domain", domain, "hash", hash, "message", err.Error())
+				return nil
+			}
+			result.Removed++
+			return nil
+		}
+		var err error
+		if domain == "" {
+			err = store.walk(check)
+		} else {
+			err = store.walkDomain(domain, check)
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func verifyHash(store hashStore, domain, hash string) error {
+	data, err := store.readHash(domain, hash)
+	if err != nil {
+		return err
+	}
+	resp := new(Response)
+	legacy, err := decodeBytes(data, resp)
+	if err != nil {
+		return corrupt(err)
+	}
+	//旧格式没有记录缓存键
+	if !legacy && hashKey(resp.Key) != hash {
+		return errors.Join(ErrCorrupt, errors.New("缓存键和文件名不符"))
+	}
+	return nil
+}
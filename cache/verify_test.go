@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	fs := NewFileStore(t.TempDir())
+	ts := &trackedStore{hashStore: fs}
+	storesMu.Lock()
+	stores["verify-test"] = ts
+	storesMu.Unlock()
+	defer func() {
+		storesMu.Lock()
+		delete(stores, "verify-test")
+		storesMu.Unlock()
+	}()
+	domain := "verify.test"
+	for _, key := range []string{"/good", "/checksum", "/moved"} {
+		if err := ts.Put(domain, key, &Response{Meta: Meta{StatusCode: 200}, Body: []byte("body" + key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//正文被修改
+	filename := fs.filename(domain, "/checksum")
+	data, _ := os.ReadFile(filename)
+	data[len(data)-1] ^= 0xff
+	_ = os.WriteFile(filename, data, 0644)
+	//文件名和缓存键不符
+	other := fs.filename(domain, "/other")
+	_ = os.MkdirAll(path.Dir(other), os.ModePerm)
+	_ = os.Rename(fs.filename(domain, "/moved"), other)
+
+	cases := []struct {
+		name    string
+		remove  bool
+		bad     int
+		removed int
+		checked int
+	}{
+		{"只检查", false, 2, 0, 3},
+		{"隔离损坏的缓存", true, 2, 2, 3},
+		{"隔离后再检查", false, 0, 0, 1},
+	}
+	for _, c := range cases {
+		result, err := Verify(domain, c.remove)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Checked != c.checked || len(result.Bad) != c.bad || result.Removed != c.removed {
+			t.Fatalf("%s:检查 %d 条，损坏 %d 条，隔离 %d 条", c.name, result.Checked, len(result.Bad), result.Removed)
+		}
+	}
+	if _, err := ts.Open(domain, "/good"); err != nil {
+		t.Fatalf("正常的缓存被隔离:%v", err)
+	}
+}
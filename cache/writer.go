@@ -0,0 +1,256 @@
+package cache
+
+import (
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+var ErrTooLarge = errors.New("超过最大缓存大小")
+
+// streamPutter 可以从流中写入正文的存储，不需要把正文全部读入内存
+type streamPutter interface {
+	putStream(domain, key string, meta *Meta, body io.Reader) error
+}
+
+// tempFiler 可以在存储目录中写临时文件、写完改名的存储，流式写入的大文件只写一遍
+type tempFiler interface {
+	createTemp(domain, key string) (*os.File, error)
+	commitTemp(domain, key, tempName string, meta *Meta) error
+}
+
+var errTempUnsupported = errors.New("存储不支持直接写入临时文件")
+
+// Writer 边输出边写缓存，正文先写到临时文件，完整读完后 Commit 写入存储，中途失败时 Abort 丢弃。
+// 存储支持时临时文件直接写在存储目录中，先预留缓存头的位置，提交时写入缓存头后改名
+type Writer struct {
+	store   Store
+	domain  string
+	key     string
+	meta    Meta
+	vary    []string
+	variant string
+	maxSize int64
+	file    *os.File
+	crc     hash.Hash32
+	size    int64
+	//直接写在存储目录中时不为空，headerLen 为预留的缓存头长度
+	temp      tempFiler
+	headerLen int
+}
+
+// NewWriter meta 为缓存头信息，有变体时 vary 和 variant 不为空。maxSize 为 0 时不限制大小
+func NewWriter(store Store, domain, key string, meta Meta, vary []string, variant string, maxSize int64) (*Writer, error) {
+	w := &Writer{
+		store:   store,
+		domain:  domain,
+		key:     key,
+		meta:    meta,
+		vary:    vary,
+		variant: variant,
+		maxSize: maxSize,
+		crc:     crc32.NewIEEE(),
+	}
+	if w.meta.Created.IsZero() {
+		w.meta.Created = time.Now()
+	}
+	if tf, ok := store.(tempFiler); ok {
+		err := w.createTemp(tf)
+		if err != nil && !errors.Is(err, errTempUnsupported) {
+			return nil, err
+		}
+	}
+	if w.file == nil {
+		file, err := os.CreateTemp("", "mirror-cache-*")
+		if err != nil {
+			return nil, err
+		}
+		w.file = file
+	}
+	return w, nil
+}
+
+// storeKey 正文实际保存的键，有变体时为变体的键
+func (w *Writer) storeKey() string {
+	if len(w.vary) == 0 {
+		return w.key
+	}
+	return VariantKey(w.key, w.variant)
+}
+
+// createTemp 按最大的 Size 和 Checksum 预留缓存头，提交时实际的缓存头不会更长
+func (w *Writer) createTemp(tf tempFiler) error {
+	w.meta.Key = w.storeKey()
+	if len(w.vary) > 0 {
+		w.meta.Variant = w.variant
+	}
+	reserved := w.meta
+	reserved.Size, reserved.Checksum = math.MaxInt64, math.MaxUint32
+	header, err := encodeHeader(&reserved, 0)
+	if err != nil {
+		return err
+	}
+	file, err := tf.createTemp(w.domain, w.meta.Key)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(make([]byte, len(header)))
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	w.file, w.temp, w.headerLen = file, tf, len(header)-prefixSize
+	return nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize {
+		return 0, ErrTooLarge
+	}
+	n, err := w.file.Write(p)
+	_, _ = w.crc.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+// Commit 写入存储并删除临时文件
+func (w *Writer) Commit() error {
+	defer w.Abort()
+	w.meta.Size = w.size
+	w.meta.Checksum = w.crc.Sum32()
+	if w.temp != nil {
+		err := w.commitTemp()
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := w.file.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		if len(w.vary) > 0 {
+			w.meta.Variant = w.variant
+		}
+		err = putStream(w.store, w.domain, w.storeKey(), &w.meta, w.file)
+		if err != nil {
+			return err
+		}
+	}
+	if len(w.vary) == 0 {
+		return nil
+	}
+	return markVariant(w.store, w.domain, w.key, w.vary, w.storeKey())
+}
+
+// commitTemp 写入缓存头，关闭后改名为缓存文件
+func (w *Writer) commitTemp() error {
+	header, err := encodeHeader(&w.meta, w.headerLen)
+	if err != nil {
+		return err
+	}
+	_, err = w.file.WriteAt(header, 0)
+	if err == nil {
+		err = w.file.Sync()
+	}
+	closeErr := w.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	tempName := w.file.Name()
+	err = w.temp.commitTemp(w.domain, w.meta.Key, tempName, &w.meta)
+	if err != nil {
+		_ = os.Remove(tempName)
+		return err
+	}
+	w.file = nil
+	return nil
+}
+
+// Abort 丢弃临时文件，可以重复调用
+func (w *Writer) Abort() {
+	if w.file == nil {
+		return
+	}
+	_ = w.file.Close()
+	_ = os.Remove(w.file.Name())
+	w.file = nil
+}
+
+// putStream 存储不支持流式写入时读入内存后写入
+func putStream(store Store, domain, key string, meta *Meta, body io.Reader) error {
+	if sp, ok := store.(streamPutter); ok {
+		return sp.putStream(domain, key, meta, body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return store.Put(domain, key, &Response{Meta: *meta, Body: data})
+}
+
+func (ts *trackedStore) putStream(domain, key string, meta *Meta, body io.Reader) error {
+	err := putStream(ts.hashStore, domain, key, meta, body)
+	if err != nil {
+		return err
+	}
+	info, err := ts.hashStore.Stat(domain, key)
+	if err != nil {
+		return err
+	}
+	tracker.add(ts, domain, hashKey(key), info.Size, meta)
+	return nil
+}
+
+func (ts *trackedStore) createTemp(domain, key string) (*os.File, error) {
+	if tf, ok := ts.hashStore.(tempFiler); ok {
+		return tf.createTemp(domain, key)
+	}
+	return nil, errTempUnsupported
+}
+
+func (ts *trackedStore) commitTemp(domain, key, tempName string, meta *Meta) error {
+	tf, ok := ts.hashStore.(tempFiler)
+	if !ok {
+		return errTempUnsupported
+	}
+	err := tf.commitTemp(domain, key, tempName, meta)
+	if err != nil {
+		return err
+	}
+	info, err := ts.hashStore.Stat(domain, key)
+	if err != nil {
+		return err
+	}
+	tracker.add(ts, domain, hashKey(key), info.Size, meta)
+	return nil
+}
+
+func (ts *TieredStore) createTemp(domain, key string) (*os.File, error) {
+	if tf, ok := ts.cold.(tempFiler); ok {
+		return tf.createTemp(domain, key)
+	}
+	return nil, errTempUnsupported
+}
+
+func (ts *TieredStore) commitTemp(domain, key, tempName string, meta *Meta) error {
+	tf, ok := ts.cold.(tempFiler)
+	if !ok {
+		return errTempUnsupported
+	}
+	_ = ts.hot.Delete(domain, key)
+	return tf.commitTemp(domain, key, tempName, meta)
+}
+
+// putStream 流式写入的都是大文件，只写磁盘，内存层中的旧内容删除
+func (ts *TieredStore) putStream(domain, key string, meta *Meta, body io.Reader) error {
+	_ = ts.hot.Delete(domain, key)
+	return putStream(ts.cold, domain, key, meta, body)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"log/slog"
@@ -10,12 +12,15 @@ import (
 	"os/signal"
 	"runtime"
 	"seo/mirror/app"
+	"seo/mirror/cache"
 	"seo/mirror/config"
 	"seo/mirror/db"
 	"seo/mirror/frontend"
 	"seo/mirror/logger"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
@@ -32,6 +37,10 @@ func main() {
 	case "restart":
 		handleStop()
 		handleStart()
+	case "warm":
+		handleWarm()
+	case "cache":
+		handleCache()
 	default:
 		fmt.Println("未知命令")
 	}
@@ -82,6 +91,225 @@ func handleStop() {
 	}
 	fmt.Println("镜像程序已关闭")
 }
+
+// handleWarm 命令行预热站点缓存，和后台的预热使用同一套流程，Ctrl+C 取消
+func handleWarm() {
+	flags := flag.NewFlagSet("warm", flag.ExitOnError)
+	concurrency := flags.Int("c", 0, "并发数，默认使用配置文件中的 warm_concurrency")
+	rate := flags.Int("r", 0, "每秒最多请求数，最大1000，默认使用配置文件中的 warm_rate")
+	urlFile := flags.String("f", "", "地址列表文件，一行一个，不填时读取源站的 sitemap.xml")
+	_ = flags.Parse(os.Args[2:])
+	if flags.NArg() < 1 {
+		fmt.Println("用法: warm [-c 并发数] [-r 每秒请求数] [-f 地址文件] 域名")
+		return
+	}
+	domain := flags.Arg(0)
+	var urls []string
+	if *urlFile != "" {
+		data, err := os.ReadFile(*urlFile)
+		if err != nil {
+			fmt.Println("读取地址文件错误", err.Error())
+			return
+		}
+		urls = strings.Split(strings.ReplaceAll(string(data), "\r", ""), "\n")
+	}
+	f, err := initFrontend()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if site, ok := f.Sites.Load(domain); ok {
+		if _, isMemory := site.(*frontend.Site).Store.(*cache.MemoryStore); isMemory {
+			fmt.Println("该站点使用内存缓存，请在后台预热")
+			return
+		}
+	}
+	job, err := f.StartWarm(domain, urls, *concurrency, *rate)
+	if err != nil {
+		fmt.Println("预热失败", err.Error())
+		return
+	}
+	ctx, cancelFunc := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer cancelFunc()
+	go func() {
+		<-ctx.Done()
+		job.Cancel()
+	}()
+	done := make(chan struct{})
+	go func() {
+		job.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			fmt.Println(job.String())
+		case <-done:
+			running = false
+		}
+	}
+	progress := job.Snapshot()
+	for _, message := range progress.Errors {
+		fmt.Println(message)
+	}
+	fmt.Println(job.String())
+}
+
+// initFrontend 命令行工具使用，按启动流程初始化配置、数据库和缓存，但不监听端口
+func initFrontend() (*frontend.Frontend, error) {
+	err := config.Init()
+	if err != nil {
+		return nil, errors.Join(errors.New("parse config error"), err)
+	}
+	err = frontend.InitS2T()
+	if err != nil {
+		return nil, errors.Join(errors.New("转繁体功能错误"), err)
+	}
+	err = db.InitDB()
+	if err != nil {
+		return nil, errors.Join(errors.New("数据库错误"), err)
+	}
+	err = cache.Init()
+	if err != nil {
+		return nil, errors.Join(errors.New("缓存初始化错误"), err)
+	}
+	f, err := frontend.NewFrontend()
+	if err != nil {
+		return nil, errors.Join(errors.New("new frontend"), err)
+	}
+	return f, nil
+}
+
+// handleCache 缓存迁移: cache export 导出站点配置和缓存，cache import 导入；cache verify 检查损坏的缓存
+func handleCache() {
+	if len(os.Args) < 3 {
+		fmt.Println("用法: cache export [-domain 域名,域名] [-o 文件] | cache import [-overwrite] 文件 | cache verify [-domain 域名] [-remove]")
+		return
+	}
+	switch os.Args[2] {
+	case "export":
+		handleCacheExport(os.Args[3:])
+	case "import":
+		handleCacheImport(os.Args[3:])
+	case "verify":
+		handleCacheVerify(os.Args[3:])
+	default:
+		fmt.Println("未知命令")
+	}
+}
+
+func handleCacheExport(args []string) {
+	flags := flag.NewFlagSet("cache export", flag.ExitOnError)
+	domains := flags.String("domain", "", "要导出的域名，多个用逗号分隔，不填导出全部站点")
+	output := flags.String("o", "", "导出文件，默认 mirror-cache-日期.tar.gz")
+	_ = flags.Parse(args)
+	if *output == "" {
+		*output = "mirror-cache-" + time.Now().Format("20060102150405") + ".tar.gz"
+	}
+	var domainList []string
+	for _, domain := range strings.Split(*domains, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domainList = append(domainList, domain)
+		}
+	}
+	f, err := initFrontend()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		fmt.Println("创建导出文件错误", err.Error())
+		return
+	}
+	result, err := f.ExportSites(file, domainList)
+	_ = file.Close()
+	if err != nil {
+		_ = os.Remove(*output)
+		fmt.Println("导出失败", err.Error())
+		return
+	}
+	for _, domain := range memoryDomains(f, result.Domains) {
+		fmt.Println(domain, "使用内存缓存，命令行无法导出缓存，请在后台导出")
+	}
+	fmt.Println("导出完成", *output, result.String())
+}
+
+// memoryDomains 返回使用内存缓存的站点，命令行进程读不到也留不下这些站点的缓存
+func memoryDomains(f *frontend.Frontend, domains []string) []string {
+	result := make([]string, 0)
+	for _, domain := range domains {
+		if site, ok := f.Sites.Load(domain); ok {
+			if _, isMemory := site.(*frontend.Site).Store.(*cache.MemoryStore); isMemory {
+				result = append(result, domain)
+			}
+		}
+	}
+	return result
+}
+
+func handleCacheImport(args []string) {
+	flags := flag.NewFlagSet("cache import", flag.ExitOnError)
+	overwrite := flags.Bool("overwrite", false, "覆盖已存在站点的配置，默认只导入缓存")
+	_ = flags.Parse(args)
+	if flags.NArg() < 1 {
+		fmt.Println("用法: cache import [-overwrite] 文件")
+		return
+	}
+	f, err := initFrontend()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Println("读取导入文件错误", err.Error())
+		return
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	result, err := f.ImportSites(file, *overwrite)
+	if result != nil {
+		for _, message := range result.Errors {
+			fmt.Println(message)
+		}
+	}
+	if err != nil {
+		fmt.Println("导入失败", err.Error())
+		return
+	}
+	for _, domain := range memoryDomains(f, result.Domains) {
+		fmt.Println(domain, "使用内存缓存，导入的缓存在命令结束后不会保留，请在后台导入")
+	}
+	fmt.Println("导入完成", result.String())
+}
+
+func handleCacheVerify(args []string) {
+	flags := flag.NewFlagSet("cache verify", flag.ExitOnError)
+	domain := flags.String("domain", "", "只检查这个域名，不填检查全部")
+	remove := flags.Bool("remove", false, "把损坏的缓存移到隔离目录，默认只报告")
+	_ = flags.Parse(args)
+	_, err := initFrontend()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	result, err := cache.Verify(*domain, *remove)
+	if result != nil {
+		for _, bad := range result.Bad {
+			fmt.Println(bad.Domain, bad.Hash, bad.Err.Error())
+		}
+	}
+	if err != nil {
+		fmt.Println("检查失败", err.Error())
+		return
+	}
+	fmt.Printf("检查%d条，损坏%d条，已隔离%d条\n", result.Checked, len(result.Bad), result.Removed)
+}
+
 func startCmd() {
 	logger.Init()
 	err := config.Init()
@@ -100,6 +328,11 @@ func startCmd() {
 		slog.Error("数据库错误:" + err.Error())
 		return
 	}
+	err = cache.Init()
+	if err != nil {
+		slog.Error("缓存初始化错误:" + err.Error())
+		return
+	}
 	application := &app.Application{}
 
 	application.Start()
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 
 	_ "github.com/glebarez/go-sqlite"
@@ -26,10 +27,142 @@ type SiteConfig struct {
 	CacheEnable      bool     `json:"cache_enable"`
 	BaiduPushKey     string   `json:"baidu_push_key"`
 	SmPushKey        string   `json:"sm_push_key"`
+	CacheStore       string   `json:"cache_store"`
+	CacheLimit       int64    `json:"cache_limit"`
+	StaleTime        int64    `json:"stale_while_revalidate"`
+	OriginCache      bool     `json:"origin_cache"`
+	KeyIgnoreParams  []string `json:"key_ignore_params"`
+	KeyAllowParams   []string `json:"key_allow_params"`
+	KeySortParams    bool     `json:"key_sort_params"`
+	KeyFoldCase      bool     `json:"key_fold_case"`
+	KeyTrimSlash     bool     `json:"key_trim_slash"`
+	VaryDimensions   []string `json:"vary_dimensions"`
+	NotFoundTime     int64    `json:"not_found_time"`
+	ErrorTime        int64    `json:"error_time"`
+	MaxCacheSize     int64    `json:"max_cache_size"`
+	CacheRules       []string `json:"cache_rules"`
+	Origins          []string `json:"origins"`
+	OriginBalance    string   `json:"origin_balance"`
+	HealthPath       string   `json:"health_path"`
+	HealthInterval   int64    `json:"health_interval"`
+	DialTimeout      int64    `json:"dial_timeout"`
+	TLSTimeout       int64    `json:"tls_timeout"`
+	HeaderTimeout    int64    `json:"header_timeout"`
+	RequestTimeout   int64    `json:"request_timeout"`
+	MaxIdleConns     int      `json:"max_idle_conns"`
+	MaxConnsPerHost  int      `json:"max_conns_per_host"`
+	HTTP2            bool     `json:"http2"`
+	RetryAttempts    int      `json:"retry_attempts"`
+	RetryBackoff     int64    `json:"retry_backoff"`
+	RetryStatuses    []string `json:"retry_statuses"`
+	RetryErrors      []string `json:"retry_errors"`
+	RetryBudget      int      `json:"retry_budget"`
+	OriginEncoding   string   `json:"origin_encoding"`
+	EgressProxy      string   `json:"egress_proxy"`
+}
+
+// Clone 返回配置的副本，切片字段也复制一份，修改副本不影响原配置
+func (data SiteConfig) Clone() SiteConfig {
+	data.Finds = slices.Clone(data.Finds)
+	data.Replaces = slices.Clone(data.Replaces)
+	data.KeyIgnoreParams = slices.Clone(data.KeyIgnoreParams)
+	data.KeyAllowParams = slices.Clone(data.KeyAllowParams)
+	data.VaryDimensions = slices.Clone(data.VaryDimensions)
+	data.CacheRules = slices.Clone(data.CacheRules)
+	data.Origins = slices.Clone(data.Origins)
+	data.RetryStatuses = slices.Clone(data.RetryStatuses)
+	data.RetryErrors = slices.Clone(data.RetryErrors)
+	return data
 }
 
 var DB *sql.DB
 
+const siteInsertColumns = "domain,url,index_title,index_keywords,index_description,finds,replaces,need_js,s2t,cache_enable,title_replace,h1replace,cache_time,baidu_push_key,sm_push_key,cache_store,cache_limit,stale_while_revalidate,origin_cache,key_ignore_params,key_allow_params,key_sort_params,key_fold_case,key_trim_slash,vary_dimensions,not_found_time,error_time,max_cache_size,cache_rules,origins,origin_balance,health_path,health_interval,dial_timeout,tls_timeout,header_timeout,request_timeout,max_idle_conns,max_conns_per_host,http2,retry_attempts,retry_backoff,retry_statuses,retry_errors,retry_budget,origin_encoding,egress_proxy"
+
+var siteColumns = "id," + siteInsertColumns
+var siteInsertHolders = strings.TrimSuffix(strings.Repeat("?,", strings.Count(siteInsertColumns, ",")+1), ",")
+
+// siteMigrations 建表之后新增的字段，启动时检查并补上
+var siteMigrations = [][2]string{
+	{"cache_store", "varchar(10) default ''"},
+	{"cache_limit", "integer default 0"},
+	{"stale_while_revalidate", "integer default 0"},
+	{"origin_cache", "boolean default false"},
+	{"key_ignore_params", "varchar(255) default ''"},
+	{"key_allow_params", "varchar(255) default ''"},
+	{"key_sort_params", "boolean default false"},
+	{"key_fold_case", "boolean default false"},
+	{"key_trim_slash", "boolean default false"},
+	{"vary_dimensions", "varchar(100) default ''"},
+	{"not_found_time", "integer default 0"},
+	{"error_time", "integer default 0"},
+	{"max_cache_size", "integer default 0"},
+	{"cache_rules", "varchar(255) default ''"},
+	{"origins", "varchar(500) default ''"},
+	{"origin_balance", "varchar(10) default ''"},
+	{"health_path", "varchar(255) default ''"},
+	{"health_interval", "integer default 0"},
+	{"dial_timeout", "integer default 0"},
+	{"tls_timeout", "integer default 0"},
+	{"header_timeout", "integer default 0"},
+	{"request_timeout", "integer default 0"},
+	{"max_idle_conns", "integer default 0"},
+	{"max_conns_per_host", "integer default 0"},
+	{"http2", "boolean default false"},
+	{"retry_attempts", "integer default 0"},
+	{"retry_backoff", "integer default 0"},
+	{"retry_statuses", "varchar(100) default ''"},
+	{"retry_errors", "varchar(100) default ''"},
+	{"retry_budget", "integer default 0"},
+	{"origin_encoding", "varchar(100) default ''"},
+	{"egress_proxy", "varchar(255) default ''"},
+}
+
+func scanSiteConfig(rs *sql.Rows, siteConfig *SiteConfig) error {
+	var findsStr, replStr, ignoreStr, allowStr, varyStr, rulesStr, originsStr, retryStatusStr, retryErrorStr string
+	err := rs.Scan(
+		&siteConfig.Id, &siteConfig.Domain, &siteConfig.Url,
+		&siteConfig.IndexTitle, &siteConfig.IndexKeywords, &siteConfig.IndexDescription,
+		&findsStr, &replStr, &siteConfig.NeedJs, &siteConfig.S2t, &siteConfig.CacheEnable,
+		&siteConfig.TitleReplace, &siteConfig.H1Replace, &siteConfig.CacheTime,
+		&siteConfig.BaiduPushKey, &siteConfig.SmPushKey, &siteConfig.CacheStore,
+		&siteConfig.CacheLimit, &siteConfig.StaleTime, &siteConfig.OriginCache,
+		&ignoreStr, &allowStr, &siteConfig.KeySortParams, &siteConfig.KeyFoldCase, &siteConfig.KeyTrimSlash,
+		&varyStr, &siteConfig.NotFoundTime, &siteConfig.ErrorTime,
+		&siteConfig.MaxCacheSize, &rulesStr, &originsStr, &siteConfig.OriginBalance,
+		&siteConfig.HealthPath, &siteConfig.HealthInterval, &siteConfig.DialTimeout, &siteConfig.TLSTimeout,
+		&siteConfig.HeaderTimeout, &siteConfig.RequestTimeout, &siteConfig.MaxIdleConns, &siteConfig.MaxConnsPerHost,
+		&siteConfig.HTTP2, &siteConfig.RetryAttempts, &siteConfig.RetryBackoff, &retryStatusStr, &retryErrorStr,
+		&siteConfig.RetryBudget, &siteConfig.OriginEncoding, &siteConfig.EgressProxy)
+	if err != nil {
+		return err
+	}
+	siteConfig.Finds = strings.Split(findsStr, ";")
+	siteConfig.Replaces = strings.Split(replStr, ";")
+	siteConfig.KeyIgnoreParams = strings.Split(ignoreStr, ";")
+	siteConfig.KeyAllowParams = strings.Split(allowStr, ";")
+	siteConfig.VaryDimensions = strings.Split(varyStr, ";")
+	siteConfig.CacheRules = strings.Split(rulesStr, ";")
+	siteConfig.Origins = strings.Split(originsStr, ";")
+	siteConfig.RetryStatuses = strings.Split(retryStatusStr, ";")
+	siteConfig.RetryErrors = strings.Split(retryErrorStr, ";")
+	return nil
+}
+
+func siteInsertArgs(data *SiteConfig) []any {
+	return []any{data.Domain, data.Url, data.IndexTitle, data.IndexKeywords, data.IndexDescription,
+		strings.Join(data.Finds, ";"), strings.Join(data.Replaces, ";"), data.NeedJs, data.S2t,
+		data.CacheEnable, data.TitleReplace, data.H1Replace, data.CacheTime, data.BaiduPushKey,
+		data.SmPushKey, data.CacheStore, data.CacheLimit, data.StaleTime, data.OriginCache,
+		strings.Join(data.KeyIgnoreParams, ";"), strings.Join(data.KeyAllowParams, ";"), data.KeySortParams,
+		data.KeyFoldCase, data.KeyTrimSlash, strings.Join(data.VaryDimensions, ";"),
+		data.NotFoundTime, data.ErrorTime, data.MaxCacheSize, strings.Join(data.CacheRules, ";"),
+		strings.Join(data.Origins, ";"), data.OriginBalance, data.HealthPath, data.HealthInterval,
+		data.DialTimeout, data.TLSTimeout, data.HeaderTimeout, data.RequestTimeout, data.MaxIdleConns,
+		data.MaxConnsPerHost, data.HTTP2, data.RetryAttempts, data.RetryBackoff,
+		strings.Join(data.RetryStatuses, ";"), strings.Join(data.RetryErrors, ";"), data.RetryBudget, data.OriginEncoding, data.EgressProxy}
+}
+
 func InitDB() error {
 	var err error
 	DB, err = sql.Open("sqlite", "config/data.db")
@@ -40,35 +173,22 @@ func InitDB() error {
 	if err != nil {
 		return err
 	}
-	return nil
+	return migrateSiteTable()
 }
 
 func GetOne(domain string) (SiteConfig, error) {
 	domain = strings.TrimSpace(domain)
 	var siteConfig SiteConfig
-	rs, err := DB.Query("select id,domain,url,index_title,index_keywords,index_description,finds,replaces,need_js,s2t,cache_enable,title_replace,h1replace,cache_time,baidu_push_key,sm_push_key from website_config where domain=?", domain)
+	rs, err := DB.Query("select "+siteColumns+" from website_config where domain=?", domain)
 	if err != nil {
 		return siteConfig, err
 	}
 
 	if rs.Next() {
-		var findsStr, replStr string
-		err = rs.Scan(
-			&siteConfig.Id,
-			&siteConfig.Domain,
-			&siteConfig.Url,
-			&siteConfig.IndexTitle,
-			&siteConfig.IndexKeywords,
-			&siteConfig.IndexDescription,
-			&findsStr, &replStr, &siteConfig.NeedJs, &siteConfig.S2t,
-			&siteConfig.CacheEnable, &siteConfig.TitleReplace, &siteConfig.H1Replace,
-			&siteConfig.CacheTime, &siteConfig.BaiduPushKey, &siteConfig.SmPushKey)
+		err = scanSiteConfig(rs, &siteConfig)
 		if err != nil {
 			return siteConfig, err
 		}
-		siteConfig.Finds = strings.Split(findsStr, ";")
-		siteConfig.Replaces = strings.Split(replStr, ";")
-
 	}
 	err = rs.Close()
 	if err != nil {
@@ -88,25 +208,17 @@ func DeleteOne(id int) error {
 	return nil
 }
 func GetAll() ([]*SiteConfig, error) {
-	rs, err := DB.Query("select id, domain,url,index_title,index_keywords,index_description,finds,replaces,need_js,s2t,cache_enable,title_replace,h1replace,cache_time,baidu_push_key,sm_push_key from website_config")
+	rs, err := DB.Query("select " + siteColumns + " from website_config")
 	if err != nil {
 		return nil, err
 	}
 	var results = make([]*SiteConfig, 0)
 	for rs.Next() {
 		var siteConfig SiteConfig
-		var findsStr, replStr string
-		err := rs.Scan(
-			&siteConfig.Id, &siteConfig.Domain, &siteConfig.Url,
-			&siteConfig.IndexTitle, &siteConfig.IndexKeywords, &siteConfig.IndexDescription,
-			&findsStr, &replStr, &siteConfig.NeedJs, &siteConfig.S2t, &siteConfig.CacheEnable,
-			&siteConfig.TitleReplace, &siteConfig.H1Replace, &siteConfig.CacheTime,
-			&siteConfig.BaiduPushKey, &siteConfig.SmPushKey)
+		err := scanSiteConfig(rs, &siteConfig)
 		if err != nil {
 			return nil, err
 		}
-		siteConfig.Finds = strings.Split(findsStr, ";")
-		siteConfig.Replaces = strings.Split(replStr, ";")
 		results = append(results, &siteConfig)
 	}
 	_ = rs.Close()
@@ -114,16 +226,16 @@ func GetAll() ([]*SiteConfig, error) {
 
 }
 func AddOne(data SiteConfig) error {
-	insertSql := `insert  into website_config(domain,url,index_title,index_keywords,index_description,finds,replaces,need_js,s2t,cache_enable,title_replace,h1replace,cache_time,baidu_push_key,sm_push_key)values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
-	_, err := DB.Exec(insertSql, data.Domain, data.Url, data.IndexTitle, data.IndexKeywords, data.IndexDescription, strings.Join(data.Finds, ";"), strings.Join(data.Replaces, ";"), data.NeedJs, data.S2t, data.CacheEnable, data.TitleReplace, data.H1Replace, data.CacheTime, data.BaiduPushKey, data.SmPushKey)
+	insertSql := "insert into website_config(" + siteInsertColumns + ")values (" + siteInsertHolders + ")"
+	_, err := DB.Exec(insertSql, siteInsertArgs(&data)...)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 func UpdateById(data SiteConfig) error {
-	updateSql := "update website_config set url=?,domain=?,index_title=?,index_keywords=?,index_description=?,finds=?,replaces=?,need_js=?,s2t=?,cache_enable=?,title_replace=?,h1replace=?,cache_time=?,baidu_push_key=?,sm_push_key=? where id=?"
-	_, err := DB.Exec(updateSql, data.Url, data.Domain, data.IndexTitle, data.IndexKeywords, data.IndexDescription, strings.Join(data.Finds, ";"), strings.Join(data.Replaces, ";"), data.NeedJs, data.S2t, data.CacheEnable, data.TitleReplace, data.H1Replace, data.CacheTime, data.BaiduPushKey, data.SmPushKey, data.Id)
+	updateSql := "update website_config set " + strings.Join(strings.Split(siteInsertColumns, ","), "=?,") + "=? where id=?"
+	_, err := DB.Exec(updateSql, append(siteInsertArgs(&data), data.Id)...)
 	if err != nil {
 		return err
 	}
@@ -132,7 +244,7 @@ func UpdateById(data SiteConfig) error {
 }
 func GetByPage(page, limit int) ([]SiteConfig, error) {
 	start := (page - 1) * limit
-	querySql := fmt.Sprintf("select * from website_config limit %d,%d", start, limit)
+	querySql := fmt.Sprintf("select %s from website_config limit %d,%d", siteColumns, start, limit)
 	rs, err := DB.Query(querySql)
 	if err != nil {
 		return nil, err
@@ -140,19 +252,10 @@ func GetByPage(page, limit int) ([]SiteConfig, error) {
 	var results = make([]SiteConfig, 0)
 	for rs.Next() {
 		var siteConfig SiteConfig
-		var findsStr, replStr string
-		err := rs.Scan(
-			&siteConfig.Id, &siteConfig.Domain, &siteConfig.Url,
-			&siteConfig.IndexTitle, &siteConfig.IndexKeywords, &siteConfig.IndexDescription,
-			&findsStr, &replStr, &siteConfig.NeedJs, &siteConfig.S2t, &siteConfig.CacheEnable,
-			&siteConfig.TitleReplace, &siteConfig.H1Replace, &siteConfig.CacheTime,
-			&siteConfig.BaiduPushKey, &siteConfig.SmPushKey)
+		err := scanSiteConfig(rs, &siteConfig)
 		if err != nil {
 			return nil, err
 		}
-		siteConfig.Finds = strings.Split(findsStr, ";")
-		siteConfig.Replaces = strings.Split(replStr, ";")
-
 		results = append(results, siteConfig)
 	}
 	_ = rs.Close()
@@ -163,9 +266,9 @@ func AddMulti(configs []*SiteConfig) error {
 	if err != nil {
 		return err
 	}
-	insetSql := `insert into website_config(domain,url,index_title,index_keywords,index_description,finds,replaces,need_js,s2t,cache_enable,title_replace,h1replace,cache_time,baidu_push_key,sm_push_key)values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
+	insetSql := "insert into website_config(" + siteInsertColumns + ")values (" + siteInsertHolders + ")"
 	for _, data := range configs {
-		_, err := tx.Exec(insetSql, data.Domain, data.Url, data.IndexTitle, data.IndexKeywords, data.IndexDescription, strings.Join(data.Finds, ";"), strings.Join(data.Replaces, ";"), data.NeedJs, data.S2t, data.CacheEnable, data.TitleReplace, data.H1Replace, data.CacheTime, data.BaiduPushKey, data.SmPushKey)
+		_, err := tx.Exec(insetSql, siteInsertArgs(data)...)
 		if err != nil {
 			_ = tx.Rollback()
 			return err
@@ -279,3 +382,31 @@ func createSiteTable() error {
 )`)
 	return err
 }
+
+func migrateSiteTable() error {
+	rs, err := DB.Query("select name from pragma_table_info('website_config')")
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]bool)
+	for rs.Next() {
+		var name string
+		err = rs.Scan(&name)
+		if err != nil {
+			_ = rs.Close()
+			return err
+		}
+		columns[name] = true
+	}
+	_ = rs.Close()
+	for _, migration := range siteMigrations {
+		if columns[migration[0]] {
+			continue
+		}
+		_, err = DB.Exec(fmt.Sprintf("alter table website_config add column %s %s", migration[0], migration[1]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
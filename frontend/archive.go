@@ -0,0 +1,202 @@
+package frontend
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"seo/mirror/cache"
+	"seo/mirror/db"
+	"slices"
+	"strings"
+	"time"
+)
+
+// 迁移包是 tar.gz，第一个文件 sites.json 为站点配置，之后每条缓存一个文件:
+//
+//	cache/<域名>/<序号>
+//
+// 缓存文件内容和缓存存储中的格式相同，导入时重新校验后写入站点当前的缓存存储
+const archiveSites = "sites.json"
+
+// ArchiveResult 导出或导入的统计
+type ArchiveResult struct {
+	Domains []string `json:"domains"`
+	Entries int      `json:"entries"`
+	Skipped int      `json:"skipped"`
+	Errors  []string `json:"errors"`
+}
+
+func (result *ArchiveResult) String() string {
+	return fmt.Sprintf("站点%d个，缓存%d条，跳过%d条", len(result.Domains), result.Entries, result.Skipped)
+}
+
+// ExportSites 把站点配置和缓存写成迁移包，domains 为空时导出全部站点
+func (f *Frontend) ExportSites(w io.Writer, domains []string) (*ArchiveResult, error) {
+	configs, err := db.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(domains) > 0 {
+		configs = slices.DeleteFunc(configs, func(siteConfig *db.SiteConfig) bool {
+			return !slices.Contains(domains, siteConfig.Domain)
+		})
+		if len(configs) != len(domains) {
+			return nil, errors.New("部分站点不存在")
+		}
+	}
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	data, err := json.Marshal(configs)
+	if err != nil {
+		return nil, err
+	}
+	err = writeArchiveFile(tw, archiveSites, data, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	result := &ArchiveResult{}
+	var buf bytes.Buffer
+	for _, siteConfig := range configs {
+		value, ok := f.Sites.Load(siteConfig.Domain)
+		if !ok {
+			continue
+		}
+		site := value.(*Site)
+		result.Domains = append(result.Domains, site.Domain)
+		exported, skipped, err := cache.Export(site.Store, site.Domain, func(resp *cache.Response) error {
+			buf.Reset()
+			err := cache.Encode(&buf, resp)
+			if err != nil {
+				return err
+			}
+			name := path.Join("cache", site.Domain, fmt.Sprint(result.Entries))
+			result.Entries++
+			return writeArchiveFile(tw, name, buf.Bytes(), resp.Created)
+		})
+		result.Skipped += skipped
+		if err != nil {
+			return result, err
+		}
+		slog.Info("导出站点缓存", "domain", site.Domain, "entries", exported, "skipped", skipped)
+	}
+	err = tw.Close()
+	if err != nil {
+		return result, err
+	}
+	return result, zw.Close()
+}
+
+func writeArchiveFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// ImportSites 导入迁移包。已存在的站点 overwrite 为 false 时保留原配置，只导入缓存。
+// 每条缓存都重新校验，校验失败、不属于包内站点或者缓存键和域名不符的跳过
+func (f *Frontend) ImportSites(r io.Reader, overwrite bool) (*ArchiveResult, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Join(errors.New("迁移包格式错误"), err)
+	}
+	tr := tar.NewReader(zr)
+	header, err := tr.Next()
+	if err != nil {
+		return nil, errors.Join(errors.New("迁移包格式错误"), err)
+	}
+	if header.Name != archiveSites {
+		return nil, errors.New("迁移包中缺少站点配置")
+	}
+	var configs []*db.SiteConfig
+	err = json.NewDecoder(tr).Decode(&configs)
+	if err != nil {
+		return nil, errors.Join(errors.New("站点配置错误"), err)
+	}
+	result := &ArchiveResult{}
+	sites := make(map[string]*Site)
+	for _, siteConfig := range configs {
+		site, err := f.importSite(*siteConfig, overwrite)
+		if err != nil {
+			result.Errors = append(result.Errors, siteConfig.Domain+": "+err.Error())
+			continue
+		}
+		sites[site.Domain] = site
+		result.Domains = append(result.Domains, site.Domain)
+	}
+	var buf bytes.Buffer
+	for {
+		header, err = tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		domain := path.Base(path.Dir(header.Name))
+		site, ok := sites[domain]
+		if !ok || !strings.HasPrefix(header.Name, "cache/") {
+			result.Skipped++
+			continue
+		}
+		buf.Reset()
+		_, err = buf.ReadFrom(tr)
+		if err != nil {
+			return result, err
+		}
+		resp := new(cache.Response)
+		err = cache.Decode(buf.Bytes(), resp)
+		if err == nil && !strings.HasPrefix(resp.Key, site.Domain) {
+			err = errors.New("缓存键和域名不符")
+		}
+		if err == nil {
+			err = site.Store.Put(site.Domain, resp.Key, resp)
+		}
+		if err != nil {
+			result.Skipped++
+			if len(result.Errors) < warmMaxErrors {
+				result.Errors = append(result.Errors, header.Name+": "+err.Error())
+			}
+			continue
+		}
+		result.Entries++
+	}
+	return result, nil
+}
+
+// importSite 保存站点配置并启用，已存在的站点按 overwrite 决定是否更新配置
+func (f *Frontend) importSite(siteConfig db.SiteConfig, overwrite bool) (*Site, error) {
+	old, err := db.GetOne(siteConfig.Domain)
+	exists := err == nil
+	if exists && !overwrite {
+		if value, ok := f.Sites.Load(siteConfig.Domain); ok {
+			return value.(*Site), nil
+		}
+		siteConfig = old
+	}
+	//NewSite 会修改配置，保存的是导入时的原始配置
+	raw := siteConfig.Clone()
+	site, err := NewSite(&siteConfig)
+	if err != nil {
+		return nil, err
+	}
+	if exists && overwrite {
+		raw.Id = old.Id
+		err = db.UpdateById(raw)
+	} else if !exists {
+		err = db.AddOne(raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.Sites.Store(site.Domain, site)
+	return site, nil
+}
@@ -0,0 +1,178 @@
+package frontend
+
+import (
+	"errors"
+	"log/slog"
+	"seo/mirror/config"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+var errBreakerOpen = errors.New("源站熔断中")
+
+// breakers 按源站的 host 共用熔断器，多个站点使用同一个源站时一起熔断
+var breakers sync.Map
+
+// breaker 源站熔断器。连续失败次数或统计周期内的失败比例达到阈值时打开，打开期间不回源；
+// 超时后进入半开状态，只放一个请求试探，成功则关闭，失败重新打开
+type breaker struct {
+	mu          sync.Mutex
+	host        string
+	state       string
+	fails       int
+	requests    int
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	probing     bool
+}
+
+func getBreaker(host string) *breaker {
+	if value, ok := breakers.Load(host); ok {
+		return value.(*breaker)
+	}
+	value, _ := breakers.LoadOrStore(host, &breaker{host: host, state: BreakerClosed, windowStart: time.Now()})
+	return value.(*breaker)
+}
+
+func breakerTimeout() time.Duration {
+	timeout := config.Conf.BreakerTimeout
+	if timeout <= 0 {
+		timeout = 30
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// ready 是否可以回源，不占用半开状态的试探名额
+func (b *breaker) ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.openedAt) >= breakerTimeout()
+	case BreakerHalfOpen:
+		return !b.probing
+	}
+	return true
+}
+
+// acquire 回源前调用，半开状态下只有一个请求能拿到试探名额
+func (b *breaker) acquire() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen {
+		if time.Since(b.openedAt) < breakerTimeout() {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fails = 0
+	b.count(false)
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+		b.setState(BreakerClosed)
+	}
+}
+
+func (b *breaker) failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fails++
+	b.count(true)
+	switch b.state {
+	case BreakerHalfOpen:
+		b.probing = false
+		b.open(err)
+	case BreakerClosed:
+		if b.tripped() {
+			b.open(err)
+		}
+	}
+}
+
+// count 统计周期内的请求数和失败数，周期结束后重新统计
+func (b *breaker) count(failed bool) {
+	window := config.Conf.BreakerWindow
+	if window <= 0 {
+		window = 60
+	}
+	if time.Since(b.windowStart) >= time.Duration(window)*time.Second {
+		b.windowStart = time.Now()
+		b.requests, b.failures = 0, 0
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+}
+
+func (b *breaker) tripped() bool {
+	maxFails, errorRate, minRequests := config.Conf.BreakerFails, config.Conf.BreakerErrorRate, config.Conf.BreakerMinRequests
+	if maxFails <= 0 {
+		maxFails = 5
+	}
+	if errorRate <= 0 {
+		errorRate = 50
+	}
+	if minRequests <= 0 {
+		minRequests = 20
+	}
+	if b.fails >= maxFails {
+		return true
+	}
+	return b.requests >= minRequests && b.failures*100 >= b.requests*errorRate
+}
+
+func (b *breaker) open(err error) {
+	b.openedAt = time.Now()
+	b.setState(BreakerOpen)
+	slog.Warn("源站熔断", "host", b.host, "fails", b.fails, "requests", b.requests, "failures", b.failures, "message", err.Error())
+}
+
+func (b *breaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	if state != BreakerOpen {
+		slog.Info("源站熔断状态变化", "host", b.host, "from", b.state, "to", state)
+	}
+	b.state = state
+	if state == BreakerClosed {
+		b.requests, b.failures = 0, 0
+		b.windowStart = time.Now()
+	}
+}
+
+// release 试探的请求被客户端取消，没有结果，让出试探名额
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) current() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= breakerTimeout() {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
@@ -0,0 +1,93 @@
+package frontend
+
+import (
+	"errors"
+	"seo/mirror/config"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	config.Conf = &config.Config{BreakerFails: 2, BreakerTimeout: 30}
+	errOrigin := errors.New("源站错误")
+	cases := []struct {
+		name string
+		run  func(b *breaker)
+		want string
+		//最后一步之后能否回源
+		acquire bool
+	}{
+		{"失败次数未到阈值", func(b *breaker) {
+			b.failure(errOrigin)
+		}, BreakerClosed, true},
+		{"成功后重新计数", func(b *breaker) {
+			b.failure(errOrigin)
+			b.success()
+			b.failure(errOrigin)
+		}, BreakerClosed, true},
+		{"连续失败后打开", func(b *breaker) {
+			b.failure(errOrigin)
+			b.failure(errOrigin)
+		}, BreakerOpen, false},
+		{"超时后半开只放一个试探请求", func(b *breaker) {
+			b.failure(errOrigin)
+			b.failure(errOrigin)
+			b.openedAt = time.Now().Add(-time.Minute)
+			if !b.acquire() {
+				t.Fatal("超时后应当可以试探")
+			}
+		}, BreakerHalfOpen, false},
+		{"试探成功后关闭", func(b *breaker) {
+			b.failure(errOrigin)
+			b.failure(errOrigin)
+			b.openedAt = time.Now().Add(-time.Minute)
+			b.acquire()
+			b.success()
+		}, BreakerClosed, true},
+		{"试探失败后重新打开", func(b *breaker) {
+			b.failure(errOrigin)
+			b.failure(errOrigin)
+			b.openedAt = time.Now().Add(-time.Minute)
+			b.acquire()
+			b.failure(errOrigin)
+		}, BreakerOpen, false},
+		{"试探被取消后让出名额", func(b *breaker) {
+			b.failure(errOrigin)
+			b.failure(errOrigin)
+			b.openedAt = time.Now().Add(-time.Minute)
+			b.acquire()
+			b.release()
+		}, BreakerHalfOpen, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := &breaker{host: "breaker.test", state: BreakerClosed, windowStart: time.Now()}
+			c.run(b)
+			if state := b.current(); state != c.want {
+				t.Fatalf("状态为 %s，应为 %s", state, c.want)
+			}
+			if ready := b.ready(); ready != c.acquire {
+				t.Fatalf("ready 为 %t，应为 %t", ready, c.acquire)
+			}
+			if acquired := b.acquire(); acquired != c.acquire {
+				t.Fatalf("acquire 为 %t，应为 %t", acquired, c.acquire)
+			}
+		})
+	}
+}
+
+func TestBreakerErrorRate(t *testing.T) {
+	config.Conf = &config.Config{BreakerFails: 100, BreakerErrorRate: 50, BreakerMinRequests: 4}
+	b := &breaker{host: "breaker.test", state: BreakerClosed, windowStart: time.Now()}
+	//失败比例达到阈值，但请求数不够时不打开
+	b.success()
+	b.failure(errors.New("源站错误"))
+	if b.current() != BreakerClosed {
+		t.Fatal("请求数不足时不应打开")
+	}
+	b.success()
+	b.failure(errors.New("源站错误"))
+	if b.current() != BreakerOpen {
+		t.Fatalf("失败比例达到阈值后状态为 %s", b.current())
+	}
+}
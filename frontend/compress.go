@@ -0,0 +1,204 @@
+package frontend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"seo/mirror/cache"
+	"seo/mirror/helper"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 按优先级排列，客户端同样支持时优先使用靠前的
+var supportedEncodings = []string{"zstd", "br", "gzip"}
+
+var (
+	gzipWriterPool   = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+	brotliWriterPool = sync.Pool{New: func() any { return brotli.NewWriterLevel(nil, 5) }}
+	zstdEncoder, _   = zstd.NewWriter(nil)
+)
+
+// defaultOriginEncoding 回源时默认声明的压缩方式，都能解压
+const defaultOriginEncoding = "gzip, deflate, br, zstd"
+
+var decodableEncodings = []string{"gzip", "deflate", "br", "zstd", "identity"}
+
+// checkOriginEncoding 回源声明的压缩方式必须都能解压，否则替换前无法读取内容
+func checkOriginEncoding(acceptEncoding string) error {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, _, _ := strings.Cut(part, ";")
+		if !slices.Contains(decodableEncodings, strings.ToLower(strings.TrimSpace(name))) {
+			return fmt.Errorf("回源压缩方式错误:%s", part)
+		}
+	}
+	return nil
+}
+
+// acceptsEncoding 客户端是否支持 Content-Encoding 中的每一种压缩方式
+func acceptsEncoding(acceptEncoding, contentEncoding string) bool {
+	for _, encoding := range strings.Split(contentEncoding, ",") {
+		encoding = strings.TrimSpace(encoding)
+		if encoding != "" && !strings.EqualFold(encoding, "identity") && acceptQuality(acceptEncoding, encoding) <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeResponse 原样输出的响应，客户端不支持源站的压缩方式时边读边解压。没有正文的响应只去掉压缩头
+func decodeResponse(response *http.Response, acceptEncoding string) error {
+	contentEncoding := response.Header.Get("Content-Encoding")
+	if contentEncoding == "" || acceptsEncoding(acceptEncoding, contentEncoding) {
+		return nil
+	}
+	if !hasBody(response) {
+		response.Header.Del("Content-Encoding")
+		response.Header.Del("Content-Length")
+		return nil
+	}
+	return decodeBody(response, contentEncoding)
+}
+
+// decodeBody 边读边解压正文，去掉 Content-Encoding 和 Content-Length
+func decodeBody(response *http.Response, contentEncoding string) error {
+	reader, err := helper.DecodeReader(response.Body, contentEncoding)
+	if err != nil {
+		return err
+	}
+	response.Body = &decodedBody{Reader: reader, decoder: reader, body: response.Body}
+	response.Header.Del("Content-Encoding")
+	response.Header.Del("Content-Length")
+	response.ContentLength = -1
+	return nil
+}
+
+// hasBody HEAD、204、304 的响应没有正文，即使声明了压缩方式也不能解压
+func hasBody(response *http.Response) bool {
+	if response.Request != nil && response.Request.Method == http.MethodHead {
+		return false
+	}
+	return response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusNotModified && response.ContentLength != 0
+}
+
+type decodedBody struct {
+	io.Reader
+	decoder io.Closer
+	body    io.Closer
+}
+
+func (d *decodedBody) Close() error {
+	_ = d.decoder.Close()
+	return d.body.Close()
+}
+
+// acceptQuality 客户端 Accept-Encoding 中对某种压缩方式的权重，0 表示不支持
+func acceptQuality(acceptEncoding, encoding string) float64 {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+		value, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return 1
+		}
+		quality, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0
+		}
+		return quality
+	}
+	return 0
+}
+
+// negotiateEncoding 选择客户端支持且权重最高的压缩方式，都不支持时返回空
+func negotiateEncoding(acceptEncoding string) string {
+	best, bestQuality := "", 0.0
+	for _, encoding := range supportedEncodings {
+		if quality := acceptQuality(acceptEncoding, encoding); quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+func compress(encoding string, content []byte) ([]byte, error) {
+	if encoding == "zstd" {
+		return zstdEncoder.EncodeAll(content, make([]byte, 0, len(content)/3)), nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(content) / 3)
+	var writer interface {
+		io.WriteCloser
+		Reset(io.Writer)
+	}
+	switch encoding {
+	case "gzip":
+		zw := gzipWriterPool.Get().(*gzip.Writer)
+		defer gzipWriterPool.Put(zw)
+		writer = zw
+	case "br":
+		bw := brotliWriterPool.Get().(*brotli.Writer)
+		defer brotliWriterPool.Put(bw)
+		writer = bw
+	default:
+		return content, nil
+	}
+	writer.Reset(&buf)
+	_, err := writer.Write(content)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// addVaryEncoding 压缩与否取决于 Accept-Encoding，需要告诉下游缓存
+func addVaryEncoding(header http.Header) {
+	for _, value := range header.Values("Vary") {
+		if strings.Contains(strings.ToLower(value), "accept-encoding") {
+			return
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
+
+// compressContent 按客户端支持的方式压缩输出内容，并设置 Content-Encoding 和 Vary
+func compressContent(header http.Header, acceptEncoding string, content []byte) []byte {
+	header.Del("Content-Encoding")
+	if !cache.Compressible(header.Get("Content-Type")) {
+		return content
+	}
+	addVaryEncoding(header)
+	encoding := negotiateEncoding(acceptEncoding)
+	if encoding == "" {
+		return content
+	}
+	compressed, err := compress(encoding, content)
+	if err != nil {
+		slog.Error("压缩错误", "encoding", encoding, "message", err.Error())
+		return content
+	}
+	header.Set("Content-Encoding", encoding)
+	return compressed
+}
+
+// encodingETag 不同压缩方式的内容不同，ETag 也要区分
+func encodingETag(etag, encoding string) string {
+	if encoding == "" {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
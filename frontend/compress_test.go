@@ -0,0 +1,45 @@
+package frontend
+
+import "testing"
+
+func TestAcceptsEncoding(t *testing.T) {
+	cases := []struct {
+		accept, content string
+		want            bool
+	}{
+		{"gzip, br", "gzip", true},
+		{"GZIP", "gzip", true},
+		{"gzip;q=0.5", "gzip", true},
+		{"gzip;q=0", "gzip", false},
+		{"br", "gzip", false},
+		{"", "gzip", false},
+		{"", "identity", true},
+		{"gzip", "", true},
+		//多次压缩时每一种都要支持
+		{"gzip, br", "gzip, br", true},
+		{"gzip", "gzip, br", false},
+	}
+	for _, c := range cases {
+		if got := acceptsEncoding(c.accept, c.content); got != c.want {
+			t.Errorf("Accept-Encoding %q 对 %q 返回 %t，应为 %t", c.accept, c.content, got, c.want)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct {
+		accept, want string
+	}{
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"gzip, br", "br"},
+		{"gzip;q=1, br;q=0.5", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"deflate", ""},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if got := negotiateEncoding(c.accept); got != c.want {
+			t.Errorf("Accept-Encoding %q 选择 %q，应为 %q", c.accept, got, c.want)
+		}
+	}
+}
@@ -3,22 +3,20 @@ package frontend
 import (
 	"bytes"
 	"context"
-	"crypto/sha1"
-	"encoding/gob"
-	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
-	"path"
+	"regexp"
+	"seo/mirror/cache"
 	"seo/mirror/config"
 	"seo/mirror/db"
 	"seo/mirror/helper"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -37,14 +35,89 @@ const (
 	SITE
 	TargetUrl
 	BUFFER
+	Validators
+	CacheKey
+	AcceptEncoding
+	Origin
+	//领头回源的请求写完缓存后调用，通知等待同一缓存键的请求
+	FlightRelease
 )
 
+type cacheState int
+
+const (
+	cacheFresh cacheState = iota
+	//已过期，但还在 stale-while-revalidate 时间内
+	cacheStale
+	cacheExpired
+)
+
+var errNotModified = errors.New("源站内容未修改")
+
 type Frontend struct {
-	Sites  *sync.Map
-	IpList []net.IP
-	proxy  *httputil.ReverseProxy
+	Sites    *sync.Map
+	IpList   []net.IP
+	proxy    *httputil.ReverseProxy
+	flight   *flight
+	warmJobs sync.Map
+	warmMu   sync.Mutex
+	//各站点的回源连接池
+	transports sync.Map
+}
+
+// flight 合并同一缓存键的并发回源，只有领头的请求回源，其余请求等它写完缓存后读缓存
+type flight struct {
+	mu    sync.Mutex
+	calls map[string]chan struct{}
+}
+
+// join 返回的 bool 为 true 时当前请求负责回源，结束后需要用返回的 chan 调用 leave
+func (fl *flight) join(key string) (chan struct{}, bool) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if done, ok := fl.calls[key]; ok {
+		return done, false
+	}
+	done := make(chan struct{})
+	fl.calls[key] = done
+	return done, true
+}
+
+// leave 提前通知后同一个键可能已经有新的领头请求，只关闭自己的 chan
+func (fl *flight) leave(key string, done chan struct{}) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.calls[key] == done {
+		close(done)
+		delete(fl.calls, key)
+	}
 }
 
+// release 返回只执行一次的 leave，缓存写完、放弃写入或请求结束时都可以调用
+func (fl *flight) release(key string, done chan struct{}) func() {
+	return sync.OnceFunc(func() {
+		fl.leave(key, done)
+	})
+}
+
+// flightRelease 不是领头请求时返回空函数
+func flightRelease(request *http.Request) func() {
+	if release, ok := request.Context().Value(FlightRelease).(func()); ok {
+		return release
+	}
+	return func() {}
+}
+
+// discardWriter 后台刷新缓存和预热时丢弃输出，只记录状态码
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(status int)      { w.status = status }
+
 var S2T *gocc.OpenCC
 
 func InitS2T() error {
@@ -75,7 +148,7 @@ func NewFrontend() (*Frontend, error) {
 		return nil, err
 	}
 
-	f := &Frontend{Sites: sites, IpList: ipList}
+	f := &Frontend{Sites: sites, IpList: ipList, flight: &flight{calls: make(map[string]chan struct{})}}
 	f.initProxy()
 	return f, nil
 }
@@ -117,8 +190,9 @@ func (f *Frontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx = context.WithValue(ctx, OriginUA, ua)
 	ctx = context.WithValue(ctx, OriginScheme, scheme)
 	ctx = context.WithValue(ctx, RequestHost, host)
-	ctx = context.WithValue(ctx, TargetUrl, site.targetUrl)
 	ctx = context.WithValue(ctx, BUFFER, buffer)
+	ctx = context.WithValue(ctx, CacheKey, site.cacheKey(r.URL))
+	ctx = context.WithValue(ctx, AcceptEncoding, r.Header.Get("Accept-Encoding"))
 	r = r.WithContext(ctx)
 	f.Route(w, r)
 	if cap(buffer.Bytes()) > 1<<20 {
@@ -129,39 +203,121 @@ func (f *Frontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (f *Frontend) Route(writer http.ResponseWriter, request *http.Request) {
 	site := request.Context().Value(SITE).(*Site)
-	cacheKey := site.Domain + request.URL.Path + request.URL.RawQuery
+	cacheKey := request.Context().Value(CacheKey).(string)
 	if site.CacheEnable {
-		cache := cachePool.Get().(*CacheResponse)
-		defer cachePool.Put(cache)
-		cache.free()
-		err := f.getCache(cacheKey, site.Domain, site.CacheTime, false, cache)
+		cacheReader, state, err := f.lookupCache(site, request, cacheKey)
 		if err == nil {
-			f.handleCacheResponse(cache, site, writer, request)
-			return
+			if state == cacheStale && request.Method != http.MethodGet {
+				state = cacheExpired
+			}
+			validators := site.validators(cacheReader.Header)
+			switch state {
+			case cacheStale:
+				f.refresh(request, cacheKey, validators)
+				fallthrough
+			case cacheFresh:
+				if f.handleCacheResponse(cacheReader, site, writer, request) == nil {
+					return
+				}
+			default:
+				_ = cacheReader.Close()
+				if validators != nil && request.Method == http.MethodGet {
+					request = request.WithContext(context.WithValue(request.Context(), Validators, validators))
+				}
+			}
+		}
+		if request.Method == http.MethodGet {
+			done, leader := f.flight.join(cacheKey)
+			if leader {
+				//流式输出时正文读完、缓存提交后就通知，不等客户端接收完
+				release := f.flight.release(cacheKey, done)
+				defer release()
+				f.forward(writer, request.WithContext(context.WithValue(request.Context(), FlightRelease, release)))
+				return
+			}
+			select {
+			case <-done:
+			case <-request.Context().Done():
+				return
+			}
+			cacheReader, state, err = f.lookupCache(site, request, cacheKey)
+			if err == nil {
+				if state == cacheFresh && f.handleCacheResponse(cacheReader, site, writer, request) == nil {
+					return
+				}
+				_ = cacheReader.Close()
+			}
+			//领头请求的响应没有写入缓存，自己回源
 		}
 	}
+	f.forward(writer, request)
+}
+
+func (f *Frontend) forward(writer http.ResponseWriter, request *http.Request) {
 	if config.Conf.UserAgent != "" {
 		request.Header.Set("User-Agent", config.Conf.UserAgent)
 	}
-	f.proxy.ServeHTTP(writer, request)
+	site := request.Context().Value(SITE).(*Site)
+	o := site.origins.pick()
+	if o == nil {
+		//源站全部熔断，不回源，直接输出缓存或错误
+		f.ErrorHandler(writer, request, errBreakerOpen)
+		return
+	}
+	ctx := context.WithValue(request.Context(), Origin, o)
+	ctx = context.WithValue(ctx, TargetUrl, o.url)
+	if site.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(site.RequestTimeout)*time.Second)
+		defer cancel()
+	}
+	f.proxy.ServeHTTP(writer, request.WithContext(ctx))
+}
+
+// refresh 后台回源更新过期缓存，已经有请求在回源时不再刷新
+func (f *Frontend) refresh(request *http.Request, cacheKey string, validators http.Header) {
+	done, leader := f.flight.join(cacheKey)
+	if !leader {
+		return
+	}
+	release := f.flight.release(cacheKey, done)
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(request.Context()), time.Minute)
+	ctx = context.WithValue(ctx, BUFFER, buffer)
+	ctx = context.WithValue(ctx, FlightRelease, release)
+	if validators != nil {
+		ctx = context.WithValue(ctx, Validators, validators)
+	}
+	r := request.Clone(ctx)
+	go func() {
+		defer func() {
+			cancel()
+			release()
+			bufferPool.Put(buffer)
+		}()
+		f.forward(&discardWriter{header: make(http.Header)}, r)
+	}()
 }
 
 func (f *Frontend) ErrorHandler(writer http.ResponseWriter, request *http.Request, e error) {
-	if !errors.Is(e, context.Canceled) {
+	if !errors.Is(e, context.Canceled) && !errors.Is(e, errNotModified) && !errors.Is(e, errBreakerOpen) {
 		slog.Error("error handler", request.URL.String(), e.Error())
 	}
 	site := request.Context().Value(SITE).(*Site)
-	cacheKey := site.Domain + request.URL.Path + request.URL.RawQuery
-	cache := cachePool.Get().(*CacheResponse)
-	defer cachePool.Put(cache)
-	cache.free()
-	err := f.getCache(cacheKey, site.Domain, site.CacheTime, true, cache)
+	cacheKey := request.Context().Value(CacheKey).(string)
+	//正常的缓存即使过期也优先输出，没有时才使用错误缓存
+	cacheReader, _, err := f.getCache(site, request, cacheKey)
+	if err != nil {
+		cacheReader, err = f.getNegative(site, cacheKey)
+	}
+	if err == nil {
+		err = f.handleCacheResponse(cacheReader, site, writer, request)
+	}
 	if err != nil {
 		writer.WriteHeader(404)
 		_, _ = writer.Write([]byte("请求出错，请检查源站"))
-		return
 	}
-	f.handleCacheResponse(cache, site, writer, request)
 }
 
 func (f *Frontend) ModifyResponse(response *http.Response) error {
@@ -172,10 +328,53 @@ func (f *Frontend) ModifyResponse(response *http.Response) error {
 		return f.handleRedirectResponse(response, requestHost)
 	}
 
-	cacheKey := site.Domain + response.Request.URL.Path + response.Request.URL.RawQuery
+	cacheKey := response.Request.Context().Value(CacheKey).(string)
+	acceptEncoding := response.Request.Context().Value(AcceptEncoding).(string)
+	//读入内存的响应在这里已经写完缓存，流式输出的由 streamResponse 负责通知
+	release := flightRelease(response.Request)
+	streaming := false
+	defer func() {
+		if !streaming {
+			release()
+		}
+	}()
+	if response.StatusCode == http.StatusNotModified && response.Request.Context().Value(Validators) != nil {
+		//源站确认缓存未修改，只更新缓存时间，由 ErrorHandler 输出缓存
+		err := f.touchCache(site, response.Request, cacheKey, response.Header)
+		if err != nil {
+			return err
+		}
+		return errNotModified
+	}
+	if response.StatusCode >= 500 && site.CacheEnable {
+		//有旧缓存时交给 ErrorHandler 输出旧缓存，错误缓存过期前不再回源
+		if cacheReader, _, err := f.getCache(site, response.Request, cacheKey); err == nil {
+			_ = cacheReader.Close()
+			f.setNegative(site, response.Request, cacheKey, response.StatusCode, "请求出错，请检查源站")
+			return fmt.Errorf("源站错误，状态码 %d", response.StatusCode)
+		}
+	}
+	if response.Request.Method == http.MethodHead || response.StatusCode == http.StatusNoContent {
+		//HEAD 和 204 没有内容可以解压、替换或缓存，只输出头信息
+		contentType := strings.ToLower(response.Header.Get("Content-Type"))
+		if strings.Contains(contentType, "text/html") || strings.Contains(contentType, "css") || strings.Contains(contentType, "javascript") {
+			//替换后的长度和源站不同
+			response.Header.Del("Content-Length")
+		}
+		f.setValidators(response, site, nil)
+		return decodeResponse(response, acceptEncoding)
+	}
 	if response.StatusCode == 200 {
+		stream, err := shouldStream(response)
+		if err != nil {
+			return err
+		}
+		if stream {
+			streaming = true
+			return f.streamResponse(site, response, cacheKey, release)
+		}
 		buffer := response.Request.Context().Value(BUFFER).(*bytes.Buffer)
-		err := helper.ReadResponse(response, buffer)
+		err = helper.ReadResponse(response, buffer)
 		if err != nil {
 			return err
 		}
@@ -194,7 +393,7 @@ func (f *Frontend) ModifyResponse(response *http.Response) error {
 				return fmt.Errorf("content is nil %s", site.targetUrl.Host+response.Request.URL.Path)
 			}
 			randomHtml := helper.RandHtml(site.Domain)
-			err = f.setCache(cacheKey, site.Domain, response.StatusCode, response.Header, content, randomHtml)
+			entry, err := f.setCache(site, response.Request, cacheKey, response.StatusCode, response.Header, content, randomHtml)
 			if err != nil {
 				return err
 			}
@@ -211,6 +410,8 @@ func (f *Frontend) ModifyResponse(response *http.Response) error {
 			if err != nil {
 				return err
 			}
+			content = compressContent(response.Header, acceptEncoding, content)
+			f.setValidators(response, site, entry)
 			helper.WrapResponseBody(response, content)
 			return nil
 		} else if strings.Contains(contentType, "css") || strings.Contains(contentType, "javascript") {
@@ -218,7 +419,7 @@ func (f *Frontend) ModifyResponse(response *http.Response) error {
 			if err != nil {
 				return err
 			}
-			err = f.setCache(cacheKey, site.Domain, response.StatusCode, response.Header, content, "")
+			entry, err := f.setCache(site, response.Request, cacheKey, response.StatusCode, response.Header, content, "")
 			if err != nil {
 				return err
 			}
@@ -226,23 +427,51 @@ func (f *Frontend) ModifyResponse(response *http.Response) error {
 				content = bytes.ReplaceAll(content, []byte(find), []byte(site.Replaces[index]))
 			}
 			content = site.replaceHost(content, scheme, requestHost)
+			content = compressContent(response.Header, acceptEncoding, content)
+			f.setValidators(response, site, entry)
 			helper.WrapResponseBody(response, content)
 			return nil
 		}
-		err = f.setCache(cacheKey, site.Domain, response.StatusCode, response.Header, content, "")
+		entry, err := f.setCache(site, response.Request, cacheKey, response.StatusCode, response.Header, content, "")
 		if err != nil {
 			return err
 		}
+		content = compressContent(response.Header, acceptEncoding, content)
+		f.setValidators(response, site, entry)
 		helper.WrapResponseBody(response, content)
 		return nil
 	}
 	if response.StatusCode > 400 && response.StatusCode < 500 {
 		response.Header.Set("Content-Type", "text/plain")
+		response.Header.Del("Content-Encoding")
 		helper.WrapResponseBody(response, []byte("访问的页面不存在"))
+		f.setNegative(site, response.Request, cacheKey, response.StatusCode, "访问的页面不存在")
+	} else if response.StatusCode >= 500 && site.negativeTTL(response.StatusCode) > 0 {
+		response.Header.Set("Content-Type", "text/plain")
+		response.Header.Del("Content-Encoding")
+		helper.WrapResponseBody(response, []byte("请求出错，请检查源站"))
+		f.setNegative(site, response.Request, cacheKey, response.StatusCode, "请求出错，请检查源站")
+	} else {
+		return decodeResponse(response, acceptEncoding)
 	}
 	return nil
 }
 
+// setValidators 回源的响应也使用和缓存一致的 ETag，没有写入缓存时去掉源站的校验头
+func (f *Frontend) setValidators(response *http.Response, site *Site, entry *cache.Response) {
+	if entry == nil {
+		response.Header.Del("ETag")
+		response.Header.Del("Last-Modified")
+		return
+	}
+	ctx := response.Request.Context()
+	requestHost := ctx.Value(RequestHost).(string)
+	scheme := ctx.Value(OriginScheme).(string)
+	isSpider := config.IsCrawler(ctx.Value(OriginUA).(string))
+	etag := encodingETag(site.etag(&entry.Meta, scheme, requestHost, isSpider), response.Header.Get("Content-Encoding"))
+	writeValidators(response.Header, etag, entry.Created)
+}
+
 func (f *Frontend) handleRedirectResponse(response *http.Response, host string) error {
 	redirectUrl, err := response.Request.URL.Parse(response.Header.Get("Location"))
 	scheme := response.Request.Context().Value(OriginScheme).(string)
@@ -274,75 +503,198 @@ func (f *Frontend) Auth() error {
 	return nil
 }
 
-func (f *Frontend) handleCacheResponse(cacheResponse *CacheResponse, site *Site, writer http.ResponseWriter, request *http.Request) {
-	contentType := strings.ToLower(cacheResponse.Header.Get("Content-Type"))
+// handleCacheResponse 输出缓存，返回错误时还没有向客户端写入任何内容
+func (f *Frontend) handleCacheResponse(cacheReader *cache.Reader, site *Site, writer http.ResponseWriter, request *http.Request) error {
+	defer func() {
+		_ = cacheReader.Close()
+	}()
 	requestHost := helper.GetHost(request)
-	requestPath := request.URL.Path
 	scheme := request.Context().Value(OriginScheme).(string)
+	isSpider := config.IsCrawler(request.Context().Value(OriginUA).(string))
+	acceptEncoding := request.Context().Value(AcceptEncoding).(string)
+	contentType := strings.ToLower(cacheReader.Header.Get("Content-Type"))
+	isHtml := strings.Contains(contentType, "text/html")
+	isText := strings.Contains(contentType, "css") || strings.Contains(contentType, "javascript")
+	compressible := cache.Compressible(contentType)
+	ranged := request.Header.Get("Range") != ""
+	//先确定输出的压缩方式，ETag 和它有关。Range 请求按未压缩的内容计算范围
+	encoding := ""
+	if compressible {
+		if isHtml || isText {
+			encoding = negotiateEncoding(acceptEncoding)
+		} else if cacheReader.Encoding != "" && !ranged && acceptQuality(acceptEncoding, cacheReader.Encoding) > 0 {
+			encoding = cacheReader.Encoding
+		}
+	}
+	etag := encodingETag(site.etag(&cacheReader.Meta, scheme, requestHost, isSpider), encoding)
+	if (cacheReader.StatusCode == 0 || cacheReader.StatusCode == 200) && helper.NotModified(request, etag, cacheReader.Created) {
+		writeValidators(writer.Header(), etag, cacheReader.Created)
+		if compressible {
+			addVaryEncoding(writer.Header())
+		}
+		writer.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	if !isHtml && !isText {
+		if encoding == "" && cacheReader.Encoding == "" && (cacheReader.StatusCode == 0 || cacheReader.StatusCode == 200) {
+			//未压缩的内容交给 ServeContent 输出，支持 Range 请求
+			f.setCacheHeader(cacheReader, writer.Header(), -1, etag, encoding)
+			http.ServeContent(writer, request, "", cacheReader.Created, cacheReader.Body)
+			return nil
+		}
+		if ranged && cacheReader.Size <= streamSize() && (cacheReader.StatusCode == 0 || cacheReader.StatusCode == 200) {
+			//压缩保存的只有读入内存处理过的小文件，解压后按 Range 输出
+			buffer := request.Context().Value(BUFFER).(*bytes.Buffer)
+			buffer.Reset()
+			err := cacheReader.ReadAll(buffer)
+			if err != nil {
+				slog.Error("读取缓存错误", "message", err.Error(), "key", cacheReader.Key)
+				if cache.IsCorrupt(err) {
+					_ = cache.Quarantine(site.Store, site.Domain, cacheReader.Key)
+				}
+				return err
+			}
+			f.setCacheHeader(cacheReader, writer.Header(), -1, etag, encoding)
+			http.ServeContent(writer, request, "", cacheReader.Created, bytes.NewReader(buffer.Bytes()))
+			return nil
+		}
+		//不需要替换内容的直接从缓存流式输出，客户端支持时直接输出压缩保存的内容
+		body := io.Reader(cacheReader.Body)
+		contentLength := cacheReader.Size
+		if cacheReader.Encoding != "" && encoding == "" {
+			decoded, err := cacheReader.DecodedBody()
+			if err != nil {
+				slog.Error("读取缓存错误", "message", err.Error(), "key", cacheReader.Key)
+				return err
+			}
+			body = decoded
+			contentLength = -1
+		}
+		f.writeCacheHeader(cacheReader, writer, contentLength, etag, encoding)
+		_, err := io.Copy(writer, body)
+		if err != nil {
+			slog.Error("写出错误", err.Error(), request.URL.String())
+		}
+		return nil
+	}
+	requestPath := request.URL.Path
 	buffer := request.Context().Value(BUFFER).(*bytes.Buffer)
-	var content = cacheResponse.Body
-	if strings.Contains(contentType, "text/html") {
-		originUserAgent := request.Context().Value(OriginUA).(string)
-		isSpider := config.IsCrawler(originUserAgent)
+	buffer.Reset()
+	err := cacheReader.ReadAll(buffer)
+	if err != nil {
+		slog.Error("读取缓存错误", "message", err.Error(), "key", cacheReader.Key)
+		if cache.IsCorrupt(err) {
+			_ = cache.Quarantine(site.Store, site.Domain, cacheReader.Key)
+		}
+		return err
+	}
+	var content = buffer.Bytes()
+	if isHtml {
 		isIndexPage := helper.IsIndexPage(requestPath, request.URL.RawQuery)
 		doc, err := html.Parse(bytes.NewReader(content))
 		if err != nil {
 			slog.Error("html parse", "message", err.Error())
 		}
-		content, err = site.handleHtmlResponse(doc, scheme, requestHost, requestPath, cacheResponse.RandomHtml, isIndexPage, isSpider, buffer)
+		buffer.Reset()
+		content, err = site.handleHtmlResponse(doc, scheme, requestHost, requestPath, cacheReader.RandomHtml, isIndexPage, isSpider, buffer)
 		if err != nil {
 			slog.Error("handleHtmlResponse", "message", err.Error())
 		}
-	} else if strings.Contains(contentType, "css") || strings.Contains(contentType, "javascript") {
+	} else {
 		for index, find := range site.Finds {
 			content = bytes.ReplaceAll(content, []byte(find), []byte(site.Replaces[index]))
 		}
 		content = site.replaceHost(content, scheme, requestHost)
 	}
-
-	for key, values := range cacheResponse.Header {
-		writer.Header()[key] = values
+	if encoding != "" {
+		compressed, err := compress(encoding, content)
+		if err != nil {
+			slog.Error("压缩错误", "encoding", encoding, "message", err.Error())
+			return err
+		}
+		content = compressed
+	}
+	f.writeCacheHeader(cacheReader, writer, int64(len(content)), etag, encoding)
+	_, err = writer.Write(content)
+	if err != nil {
+		slog.Error("写出错误", err.Error(), request.URL.String())
 	}
-	writer.Header().Set("Content-Length", strconv.FormatInt(int64(len(content)), 10))
-	if cacheResponse.StatusCode != 0 {
-		writer.WriteHeader(cacheResponse.StatusCode)
+	return nil
+}
+
+// writeCacheHeader contentLength 小于 0 时不设置 Content-Length，encoding 为输出内容的压缩方式
+func (f *Frontend) writeCacheHeader(cacheReader *cache.Reader, writer http.ResponseWriter, contentLength int64, etag, encoding string) {
+	f.setCacheHeader(cacheReader, writer.Header(), contentLength, etag, encoding)
+	if cacheReader.StatusCode != 0 {
+		writer.WriteHeader(cacheReader.StatusCode)
 	} else {
 		writer.WriteHeader(200)
 	}
-	_, err := writer.Write(content)
-	if err != nil {
-		slog.Error("写出错误", err.Error(), request.URL.String())
+}
+
+// setCacheHeader 设置缓存响应的头信息，不写状态码
+func (f *Frontend) setCacheHeader(cacheReader *cache.Reader, header http.Header, contentLength int64, etag, encoding string) {
+	for key, values := range cacheReader.Header {
+		header[key] = slices.Clone(values)
+	}
+	//缓存头中是源站的长度，和输出内容的压缩方式可能不同
+	if contentLength >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	} else {
+		header.Del("Content-Length")
+	}
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+	if cache.Compressible(cacheReader.Header.Get("Content-Type")) {
+		addVaryEncoding(header)
 	}
+	if cacheReader.StatusCode == 0 || cacheReader.StatusCode == 200 {
+		writeValidators(header, etag, cacheReader.Created)
+	}
+}
+
+// writeValidators 用镜像生成的 ETag 和 Last-Modified 替换源站的
+func writeValidators(header http.Header, etag string, lastModified time.Time) {
+	header.Set("ETag", etag)
+	header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
 }
 
 func (f *Frontend) initProxy() {
-	transport := &http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			localIp := net.IPv4(0, 0, 0, 0)
-			if len(f.IpList) > 0 {
-				ipIndex := rand.IntN(len(f.IpList))
-				localIp = f.IpList[ipIndex]
-			}
-			localAddr := &net.TCPAddr{IP: localIp, Port: 0, Zone: ""}
-			var dialer = net.Dialer{
-				LocalAddr: localAddr,
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}
-			return dialer.DialContext(ctx, network, addr)
-		},
-	}
 	rewrite := func(request *httputil.ProxyRequest) {
 		target := request.In.Context().Value(TargetUrl).(*url.URL)
-		request.Out.Header.Set("Referer", target.Scheme+"://"+target.Host)
+		site := request.In.Context().Value(SITE).(*Site)
+		request.Out.Header.Set("Referer", site.targetUrl.Scheme+"://"+site.targetUrl.Host)
+		request.Out.Header.Set("Accept-Encoding", site.originEncoding())
 		request.Out.Header.Del("If-Modified-Since")
 		request.Out.Header.Del("If-None-Match")
+		if validators, ok := request.In.Context().Value(Validators).(http.Header); ok {
+			for key, values := range validators {
+				request.Out.Header[key] = values
+			}
+		}
 		request.SetURL(target)
+		//源站指定了 Host 时按指定的域名访问，TLS 的 ServerName 由连接池设置
+		if o, ok := request.In.Context().Value(Origin).(*origin); ok && o.host != "" {
+			request.Out.Host = o.host
+		}
 	}
-	f.proxy = &httputil.ReverseProxy{Rewrite: rewrite, Transport: transport}
+	f.proxy = &httputil.ReverseProxy{Rewrite: rewrite, Transport: &originTransport{&siteRoundTripper{f}}}
 	f.proxy.ModifyResponse = f.ModifyResponse
 	f.proxy.ErrorHandler = f.ErrorHandler
 }
+
+// CacheExpiry 各站点的缓存时间，供过期缓存清理使用
+func (f *Frontend) CacheExpiry() map[string]cache.Expiry {
+	expiry := make(map[string]cache.Expiry)
+	f.Sites.Range(func(key, value any) bool {
+		site := value.(*Site)
+		expiry[site.Domain] = site.expiry()
+		return true
+	})
+	return expiry
+}
+
 func (f *Frontend) querySite(host string) (*Site, error) {
 	hostParts := strings.Split(host, ".")
 	if len(hostParts) == 1 {
@@ -355,36 +707,139 @@ func (f *Frontend) querySite(host string) (*Site, error) {
 	return f.querySite(strings.Join(hostParts[1:], "."))
 }
 
-func (f *Frontend) getCache(requestUrl string, domain string, cacheTime int64, force bool, cache *CacheResponse) error {
-	sum := sha1.Sum([]byte(requestUrl))
-	hash := hex.EncodeToString(sum[:])
-	dir := path.Join(config.Conf.CachePath, domain, hash[:2])
-	filename := path.Join(dir, hash)
-	fileInfo, err := os.Stat(filename)
+// getCache 读取缓存并判断是否过期，过期的缓存也会返回，由调用方决定是否使用。
+// 有变体时按请求的取值读取对应的变体
+func (f *Frontend) getCache(site *Site, request *http.Request, requestUrl string) (*cache.Reader, cacheState, error) {
+	cacheReader, err := site.Store.Open(site.Domain, requestUrl)
 	if err != nil {
-		return err
+		return nil, cacheExpired, err
+	}
+	if cacheReader.IsMarker() {
+		_ = cacheReader.Close()
+		variantKey := cache.VariantKey(requestUrl, site.variant(request, cacheReader.Vary))
+		cacheReader, err = site.Store.Open(site.Domain, variantKey)
+		if err != nil {
+			return nil, cacheExpired, err
+		}
 	}
-	if modTime := fileInfo.ModTime(); !force && time.Now().Unix() > modTime.Unix()+cacheTime*60*60 {
-		return fmt.Errorf("%s缓存已经过期 %s", domain, requestUrl)
+	expires := site.expires(&cacheReader.Meta)
+	now := time.Now()
+	if now.Before(expires) {
+		return cacheReader, cacheFresh, nil
 	}
-	file, err := os.Open(filename)
-	if err != nil {
-		return err
+	if now.Before(expires.Add(time.Duration(site.StaleTime) * time.Minute)) {
+		return cacheReader, cacheStale, nil
 	}
-	err = gob.NewDecoder(file).Decode(cache)
+	return cacheReader, cacheExpired, nil
+}
+
+// lookupCache 读取请求使用的缓存，正常的缓存不存在或已过期时使用未过期的错误缓存。
+// 过期的正常缓存只让位给 404、410；5xx 的错误缓存未过期时说明源站仍在出错，直接输出过期的正常缓存，不再回源
+func (f *Frontend) lookupCache(site *Site, request *http.Request, requestUrl string) (*cache.Reader, cacheState, error) {
+	cacheReader, state, err := f.getCache(site, request, requestUrl)
+	if err == nil && state != cacheExpired {
+		return cacheReader, state, nil
+	}
+	negative, negativeErr := f.getNegative(site, requestUrl)
+	if negativeErr != nil {
+		return cacheReader, state, err
+	}
+	if err == nil {
+		if negative.StatusCode >= 500 {
+			_ = negative.Close()
+			return cacheReader, cacheFresh, nil
+		}
+		_ = cacheReader.Close()
+	}
+	return negative, cacheFresh, nil
+}
+
+// getNegative 读取未过期的错误缓存
+func (f *Frontend) getNegative(site *Site, requestUrl string) (*cache.Reader, error) {
+	cacheReader, err := site.Store.Open(site.Domain, cache.NegativeKey(requestUrl))
 	if err != nil {
+		return nil, err
+	}
+	if time.Since(cacheReader.Created) >= site.negativeTTL(cacheReader.StatusCode) {
+		_ = cacheReader.Close()
+		return nil, cache.ErrNotFound
+	}
+	return cacheReader, nil
+}
 
-		return err
+// setNegative 按站点配置缓存源站的错误响应，写入失败只记录日志
+func (f *Frontend) setNegative(site *Site, request *http.Request, requestUrl string, statusCode int, content string) {
+	if !site.CacheEnable || request.Method != http.MethodGet || site.negativeTTL(statusCode) <= 0 {
+		return
 	}
-	err = file.Close()
+	resp := new(cache.Response)
+	resp.Header = http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+	resp.Body = []byte(content)
+	resp.StatusCode = statusCode
+	resp.Created = time.Now()
+	err := site.Store.Put(site.Domain, cache.NegativeKey(requestUrl), resp)
 	if err != nil {
+		slog.Error("写入错误缓存失败", "key", requestUrl, "message", err.Error())
+	}
+}
 
+// touchCache 源站返回304时更新缓存时间
+func (f *Frontend) touchCache(site *Site, request *http.Request, requestUrl string, header http.Header) error {
+	resp := new(cache.Response)
+	err := site.Store.Get(site.Domain, requestUrl, resp)
+	if err != nil {
 		return err
 	}
-	return nil
+	if resp.IsMarker() {
+		requestUrl = cache.VariantKey(requestUrl, site.variant(request, resp.Vary))
+		resp = new(cache.Response)
+		err = site.Store.Get(site.Domain, requestUrl, resp)
+		if err != nil {
+			return err
+		}
+	}
+	resp.Created = time.Now()
+	resp.Expires = time.Time{}
+	if ttl, _, ok := helper.OriginFreshness(header); ok {
+		resp.Expires = resp.Created.Add(min(ttl, site.cacheTTL(site.metaPath(&resp.Meta), resp.Header)))
+	}
+	return site.Store.Put(site.Domain, requestUrl, resp)
 }
 
-func (f *Frontend) setCache(url string, domain string, statusCode int, header http.Header, content []byte, randomHtml string) error {
+// setCache 写入缓存，返回写入的缓存，不需要缓存时返回 nil
+func (f *Frontend) setCache(site *Site, request *http.Request, url string, statusCode int, header http.Header, content []byte, randomHtml string) (*cache.Response, error) {
+	if site.MaxCacheSize > 0 && int64(len(content)) > site.MaxCacheSize<<20 {
+		return nil, nil
+	}
+	resp, vary := f.newEntry(site, request.URL.Path, statusCode, header, randomHtml)
+	if resp == nil {
+		return nil, nil
+	}
+	resp.Body = content
+	err := cache.Compress(resp)
+	if err != nil {
+		return nil, err
+	}
+	if len(vary) > 0 {
+		err = cache.PutVariant(site.Store, site.Domain, url, vary, site.variant(request, vary), resp)
+	} else {
+		err = site.Store.Put(site.Domain, url, resp)
+	}
+	if errors.Is(err, cache.ErrTooManyVariants) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// newEntry 按站点规则整理响应头，生成不含正文的缓存，同时返回区分变体的字段。不需要缓存时返回 nil
+func (f *Frontend) newEntry(site *Site, requestPath string, statusCode int, header http.Header, randomHtml string) (*cache.Response, []string) {
+	vary, cacheable := site.varyFields(header)
+	if !cacheable {
+		return nil, nil
+	}
 	contentType := header.Get("Content-Type")
 	if strings.Contains(strings.ToLower(contentType), "charset") {
 		contentPartArr := strings.Split(contentType, ";")
@@ -392,33 +847,80 @@ func (f *Frontend) setCache(url string, domain string, statusCode int, header ht
 	}
 	header.Del("Content-Encoding")
 	header.Del("Content-Security-Policy")
-	resp := new(CacheResponse)
+	site.addVary(header)
+	resp := new(cache.Response)
 	resp.Header = header
-	resp.Body = content
 	resp.StatusCode = statusCode
 	resp.RandomHtml = randomHtml
-	sum := sha1.Sum([]byte(url))
-	hash := hex.EncodeToString(sum[:])
-	dir := path.Join(config.Conf.CachePath, domain, hash[:2])
-	if !helper.IsExist(dir) {
-		err := os.MkdirAll(dir, os.ModePerm)
-		if err != nil {
-			slog.Error("mkdirAll error", dir, err.Error())
-			return err
+	resp.Path = requestPath
+	resp.Created = time.Now()
+	if site.OriginCache {
+		ttl, cacheable, ok := helper.OriginFreshness(header)
+		if !cacheable {
+			return nil, nil
+		}
+		if ok {
+			resp.Expires = resp.Created.Add(min(ttl, site.cacheTTL(requestPath, header)))
 		}
 	}
-	filename := path.Join(dir, hash)
-	file, err := os.Create(filename)
-	if err != nil {
-		slog.Error("os.Create error", filename, err.Error())
-		return err
+	return resp, vary
+}
+
+// PurgeCache 按地址(url)、路径前缀(prefix)、正则(regex)或单条缓存的哈希(hash)删除站点的缓存，
+// 前三种方式变体和标记一起删除，返回删除的数量
+func (f *Frontend) PurgeCache(domain, mode, pattern string) (int, error) {
+	value, ok := f.Sites.Load(domain)
+	if !ok {
+		return 0, errors.New("站点不存在")
+	}
+	site := value.(*Site)
+	if pattern == "" {
+		return 0, errors.New("删除条件不能为空")
+	}
+	var match func(requestPath string) bool
+	var key string
+	switch mode {
+	case "url":
+		u, err := url.Parse(pattern)
+		if err != nil {
+			return 0, err
+		}
+		key = site.cacheKey(u)
+		match = func(requestPath string) bool { return site.Domain+requestPath == key }
+	case "prefix":
+		if site.KeyFoldCase {
+			pattern = strings.ToLower(pattern)
+		}
+		match = func(requestPath string) bool { return strings.HasPrefix(requestPath, pattern) }
+	case "regex":
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return 0, errors.Join(errors.New("正则表达式错误"), err)
+		}
+		match = re.MatchString
+	case "hash":
+	default:
+		return 0, errors.New("未知的删除方式")
+	}
+	matched := make([]cache.Entry, 0)
+	for _, entry := range cache.Entries(site.Store, domain) {
+		if mode == "hash" {
+			if entry.Hash == pattern {
+				matched = append(matched, entry)
+			}
+			continue
+		}
+		if entry.Key == "" {
+			continue
+		}
+		if match(strings.TrimPrefix(entry.BaseKey(), site.Domain)) {
+			matched = append(matched, entry)
+		}
 	}
-	defer func() {
-		_ = file.Close()
-	}()
-	if err = gob.NewEncoder(file).Encode(resp); err != nil {
-		slog.Error("gob.NewEncoder error", filename, err.Error())
-		return err
+	count, err := cache.DeleteEntries(site.Store, domain, matched)
+	if err != nil || key == "" {
+		return count, err
 	}
-	return nil
+	//不支持索引的存储里的缓存也要删除
+	return count, cache.Purge(site.Store, domain, key)
 }
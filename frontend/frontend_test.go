@@ -0,0 +1,185 @@
+package frontend
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"seo/mirror/cache"
+	"seo/mirror/config"
+	"seo/mirror/db"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestFrontend 只有一个站点的前端，使用内存缓存
+func newTestFrontend(t *testing.T, siteConfig *db.SiteConfig) *Frontend {
+	t.Helper()
+	config.Conf = &config.Config{
+		CachePath:   t.TempDir(),
+		CacheStore:  cache.StoreMemory,
+		AuthInfo:    &config.AuthInfo{Date: "2099-01-01"},
+		AdDomains:   map[string]bool{},
+		FriendLinks: map[string][]string{},
+	}
+	site, err := NewSite(siteConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = site.Store.PurgeDomain(site.Domain)
+	f := &Frontend{Sites: new(sync.Map), flight: &flight{calls: make(map[string]chan struct{})}}
+	f.Sites.Store(site.Domain, site)
+	f.initProxy()
+	return f
+}
+
+func serve(f *Frontend, target string) *http.Response {
+	recorder := httptest.NewRecorder()
+	f.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+	return recorder.Result()
+}
+
+// blockingWriter 模拟接收很慢的客户端，写正文时一直阻塞到 unblock 关闭
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestFlightReleasedBeforeLeaderFinishes(t *testing.T) {
+	var hits atomic.Int32
+	hit := make(chan struct{}, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		hit <- struct{}{}
+		//等跟随的请求加入后再返回
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+	f := newTestFrontend(t, &db.SiteConfig{Domain: "example.com", Url: origin.URL, CacheEnable: true, CacheTime: 1})
+	leader := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), unblock: make(chan struct{})}
+	defer close(leader.unblock)
+	go f.ServeHTTP(leader, httptest.NewRequest(http.MethodGet, "http://www.example.com/file.bin", nil))
+	<-hit
+	followed := make(chan *http.Response)
+	go func() {
+		followed <- serve(f, "http://www.example.com/file.bin")
+	}()
+	select {
+	case response := <-followed:
+		body, _ := io.ReadAll(response.Body)
+		if string(body) != "content" {
+			t.Errorf("跟随请求的内容为 %q", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("领头请求写完缓存后跟随请求仍在等待")
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("回源 %d 次，应为 1 次", n)
+	}
+}
+
+func TestFlightLeaveKeepsNewLeader(t *testing.T) {
+	fl := &flight{calls: make(map[string]chan struct{})}
+	first, _ := fl.join("key")
+	fl.release("key", first)()
+	second, leader := fl.join("key")
+	if !leader {
+		t.Fatal("提前通知后应由新的请求领头")
+	}
+	fl.leave("key", first)
+	if _, leader := fl.join("key"); leader {
+		t.Fatal("旧的领头请求结束时不应移除新的领头请求")
+	}
+	fl.leave("key", second)
+}
+
+func TestErrorCacheServesStaleWithoutOrigin(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer origin.Close()
+	f := newTestFrontend(t, &db.SiteConfig{Domain: "example.com", Url: origin.URL, CacheEnable: true, CacheTime: 1, ErrorTime: 10})
+	value, _ := f.Sites.Load("example.com")
+	site := value.(*Site)
+	stale := &cache.Response{Meta: cache.Meta{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Created:    time.Now().Add(-48 * time.Hour),
+	}, Body: []byte("stale")}
+	key := site.Domain + "/file.txt"
+	if err := site.Store.Put(site.Domain, key, stale); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		response := serve(f, "http://www.example.com/file.txt")
+		body, _ := io.ReadAll(response.Body)
+		if string(body) != "stale" {
+			t.Fatalf("第 %d 次请求状态码 %d，内容 %q，应输出旧缓存", i+1, response.StatusCode, body)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("回源 %d 次，错误缓存未过期时应只回源 1 次", n)
+	}
+}
+
+func TestNotModifiedRoundTrip(t *testing.T) {
+	var hits atomic.Int32
+	var ifNoneMatch atomic.Value
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		ifNoneMatch.Store(r.Header.Get("If-None-Match"))
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer origin.Close()
+	f := newTestFrontend(t, &db.SiteConfig{Domain: "example.com", Url: origin.URL, CacheEnable: true, CacheTime: 1, OriginCache: true})
+	value, _ := f.Sites.Load("example.com")
+	site := value.(*Site)
+	stale := &cache.Response{Meta: cache.Meta{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/plain"}, "Etag": {`"v1"`}},
+		Created:    time.Now().Add(-48 * time.Hour),
+	}, Body: []byte("cached")}
+	key := site.Domain + "/file.txt"
+	if err := site.Store.Put(site.Domain, key, stale); err != nil {
+		t.Fatal(err)
+	}
+	//过期的缓存带上源站的 ETag 回源，源站返回 304 后输出缓存并更新缓存时间，之后不再回源
+	etag := ""
+	for i := 0; i < 2; i++ {
+		response := serve(f, "http://www.example.com/file.txt")
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != http.StatusOK || string(body) != "cached" {
+			t.Fatalf("第 %d 次请求状态码 %d，内容 %q", i+1, response.StatusCode, body)
+		}
+		etag = response.Header.Get("ETag")
+	}
+	if n := hits.Load(); n != 1 || ifNoneMatch.Load() != `"v1"` {
+		t.Fatalf("回源 %d 次，If-None-Match 为 %v", n, ifNoneMatch.Load())
+	}
+	resp := new(cache.Response)
+	if err := site.Store.Get(site.Domain, key, resp); err != nil || time.Since(resp.Created) > time.Minute {
+		t.Fatalf("缓存时间没有更新:%v", err)
+	}
+	//客户端带上输出的 ETag 时直接返回 304
+	request := httptest.NewRequest(http.MethodGet, "http://www.example.com/file.txt", nil)
+	request.Header.Set("If-None-Match", etag)
+	recorder := httptest.NewRecorder()
+	f.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 {
+		t.Fatalf("带 ETag 的请求状态码 %d，内容长度 %d", recorder.Code, recorder.Body.Len())
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("回源 %d 次", n)
+	}
+}
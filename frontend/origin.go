@@ -0,0 +1,355 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"seo/mirror/config"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BalanceRoundRobin = ""
+	BalanceWeighted   = "weighted"
+)
+
+// healthTimeout 检查的超时时间，检查间隔更短时使用检查间隔
+const healthTimeout = 10 * time.Second
+
+var healthClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// origin 站点的一个源站
+type origin struct {
+	url    *url.URL
+	weight int
+	//回源和检查时使用的 Host，同时作为 TLS 的 ServerName，为空时使用地址中的域名
+	host string
+	//平滑加权轮询的当前权重
+	current int
+	//主动检查失败
+	down      bool
+	lastError string
+	checked   time.Time
+	breaker   *breaker
+}
+
+// originPool 站点的源站列表，按轮询或权重选择可用的源站。主动检查失败的源站在没有其他可用源站时仍然使用，
+// 熔断的源站不使用，全部熔断时不回源。故障状态只由主动检查标记，回源失败只计入熔断器
+type originPool struct {
+	mu         sync.Mutex
+	origins    []*origin
+	weighted   bool
+	next       int
+	healthPath string
+	interval   time.Duration
+	nextCheck  time.Time
+}
+
+// OriginStatus 源站的健康状态
+type OriginStatus struct {
+	Url       string    `json:"url"`
+	Weight    int       `json:"weight"`
+	Healthy   bool      `json:"healthy"`
+	Breaker   string    `json:"breaker"`
+	LastError string    `json:"last_error"`
+	Checked   time.Time `json:"checked"`
+}
+
+func (status OriginStatus) String() string {
+	switch {
+	case status.Breaker == BreakerOpen:
+		return fmt.Sprintf("%s 熔断(%s)", status.Url, status.LastError)
+	case status.Breaker == BreakerHalfOpen:
+		return status.Url + " 熔断恢复中"
+	case !status.Healthy:
+		return fmt.Sprintf("%s 故障(%s)", status.Url, status.LastError)
+	}
+	return status.Url + " 正常"
+}
+
+// newOriginPool origins 为空时只使用主源站。每一项为 地址 或 地址=权重，权重默认为 1，
+// 后面可以加 ,host=域名 指定回源的 Host，用 IP 或其他域名访问主源站的服务器时使用
+func newOriginPool(primary *url.URL, origins []string, balance, healthPath string, interval int64) (*originPool, error) {
+	pool := &originPool{
+		weighted:   balance == BalanceWeighted,
+		healthPath: healthPath,
+		interval:   time.Duration(interval) * time.Second,
+	}
+	if balance != BalanceRoundRobin && balance != BalanceWeighted {
+		return nil, fmt.Errorf("负载方式错误:%s", balance)
+	}
+	if pool.healthPath != "" && !strings.HasPrefix(pool.healthPath, "/") {
+		pool.healthPath = "/" + pool.healthPath
+	}
+	for _, item := range origins {
+		item, options, _ := strings.Cut(strings.TrimSpace(item), ",")
+		host := ""
+		for _, option := range strings.Split(options, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+			switch {
+			case name == "":
+			case name == "host" && value != "":
+				host = strings.TrimSpace(value)
+			default:
+				return nil, fmt.Errorf("源站参数错误:%s", option)
+			}
+		}
+		weight := 1
+		if index := strings.LastIndex(item, "="); index > 0 {
+			if w, err := strconv.Atoi(item[index+1:]); err == nil {
+				if w <= 0 {
+					return nil, fmt.Errorf("源站权重错误:%s", item)
+				}
+				item, weight = item[:index], w
+			}
+		}
+		u, err := url.Parse(item)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, errors.Join(fmt.Errorf("源站列表错误:%s", item), err)
+		}
+		pool.origins = append(pool.origins, &origin{url: u, weight: weight, host: host, breaker: getBreaker(u.Host)})
+	}
+	if len(pool.origins) == 0 {
+		pool.origins = append(pool.origins, &origin{url: primary, weight: 1, breaker: getBreaker(primary.Host)})
+	}
+	return pool, nil
+}
+
+// pick 选择一个源站，全部熔断时返回 nil
+func (pool *originPool) pick() *origin {
+	return pool.pickExcept(nil)
+}
+
+// pickExcept 重试时优先选择 exclude 以外的源站，没有其他可用的源站时仍然选它
+func (pool *originPool) pickExcept(exclude *origin) *origin {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if exclude != nil {
+		if picked := pool.choose(exclude); picked != nil {
+			return picked
+		}
+	}
+	return pool.choose(nil)
+}
+
+// choose 在 exclude 以外的源站中选择并占用熔断器的名额，需要持有锁
+func (pool *originPool) choose(exclude *origin) *origin {
+	candidates := make([]*origin, 0, len(pool.origins))
+	for _, o := range pool.origins {
+		if o != exclude && !o.down && o.breaker.ready() {
+			candidates = append(candidates, o)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, o := range pool.origins {
+			if o != exclude && o.breaker.ready() {
+				candidates = append(candidates, o)
+			}
+		}
+	}
+	//选中的源站半开探测名额被占用时，撤销这次选择，从剩下的源站中重新选
+	for len(candidates) > 0 {
+		var picked *origin
+		total := 0
+		if !pool.weighted {
+			pool.next++
+			picked = candidates[pool.next%len(candidates)]
+		} else {
+			for _, o := range candidates {
+				o.current += o.weight
+				total += o.weight
+				if picked == nil || o.current > picked.current {
+					picked = o
+				}
+			}
+			picked.current -= total
+		}
+		if picked.breaker.acquire() {
+			return picked
+		}
+		if !pool.weighted {
+			pool.next--
+		} else {
+			for _, o := range candidates {
+				o.current -= o.weight
+			}
+			picked.current += total
+		}
+		candidates = slices.DeleteFunc(candidates, func(o *origin) bool {
+			return o == picked
+		})
+	}
+	return nil
+}
+
+// fail 记录回源失败
+func (pool *originPool) fail(o *origin, err error) {
+	pool.mu.Lock()
+	o.lastError = err.Error()
+	pool.mu.Unlock()
+	o.breaker.failure(err)
+}
+
+// succeed 记录回源成功
+func (pool *originPool) succeed(o *origin) {
+	o.breaker.success()
+}
+
+func (pool *originPool) status() []OriginStatus {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	result := make([]OriginStatus, len(pool.origins))
+	for i, o := range pool.origins {
+		state := o.breaker.current()
+		result[i] = OriginStatus{
+			Url:       o.url.String(),
+			Weight:    o.weight,
+			Healthy:   !o.down && state == BreakerClosed,
+			Breaker:   state,
+			LastError: o.lastError,
+			Checked:   o.checked,
+		}
+	}
+	return result
+}
+
+// due 到了检查时间时返回需要检查的源站
+func (pool *originPool) due(now time.Time) []*origin {
+	if pool.interval <= 0 {
+		return nil
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if now.Before(pool.nextCheck) {
+		return nil
+	}
+	pool.nextCheck = now.Add(pool.interval)
+	return pool.origins
+}
+
+// check 请求源站的检查地址，状态码小于 400 为正常
+func (pool *originPool) check(ctx context.Context, transport http.RoundTripper, o *origin) {
+	checkUrl := o.url.ResolveReference(&url.URL{Path: pool.healthPath})
+	ctx, cancel := context.WithTimeout(ctx, min(pool.interval, healthTimeout))
+	defer cancel()
+	err := func() error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, checkUrl.String(), nil)
+		if err != nil {
+			return err
+		}
+		request.Host = o.host
+		if config.Conf.UserAgent != "" {
+			request.Header.Set("User-Agent", config.Conf.UserAgent)
+		}
+		client := *healthClient
+		client.Transport = transport
+		response, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		_ = response.Body.Close()
+		if response.StatusCode >= 400 {
+			return fmt.Errorf("状态码 %d", response.StatusCode)
+		}
+		return nil
+	}()
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	o.checked = time.Now()
+	if err == nil {
+		if o.down {
+			slog.Info("源站检查恢复", "origin", o.url.String())
+		}
+		o.down = false
+		return
+	}
+	o.lastError = err.Error()
+	if !o.down {
+		o.down = true
+		slog.Warn("源站检查失败", "origin", o.url.String(), "message", o.lastError)
+	}
+}
+
+// HealthCheck 定时检查所有站点配置了检查间隔的源站
+type HealthCheck struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (f *Frontend) StartHealthCheck() *HealthCheck {
+	hc := &HealthCheck{stop: make(chan struct{}), done: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer close(hc.done)
+		defer cancel()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hc.stop:
+				return
+			case now := <-ticker.C:
+				f.Sites.Range(func(key, value any) bool {
+					site := value.(*Site)
+					for _, o := range site.origins.due(now) {
+						go site.origins.check(ctx, f.transport(site, o), o)
+					}
+					return true
+				})
+			}
+		}
+	}()
+	return hc
+}
+
+func (hc *HealthCheck) Stop() {
+	close(hc.stop)
+	<-hc.done
+}
+
+// OriginStatus 返回站点各源站的状态
+func (f *Frontend) OriginStatus(domain string) []OriginStatus {
+	value, ok := f.Sites.Load(domain)
+	if !ok {
+		return nil
+	}
+	return value.(*Site).origins.status()
+}
+
+// originTransport 记录回源结果，连接错误和源站网关错误算作失败，客户端取消的不算
+type originTransport struct {
+	http.RoundTripper
+}
+
+func (t *originTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	site, ok := request.Context().Value(SITE).(*Site)
+	o, _ := request.Context().Value(Origin).(*origin)
+	if !ok || o == nil {
+		return t.RoundTripper.RoundTrip(request)
+	}
+	return t.roundTrip(site, o, request)
+}
+
+func (t *originTransport) record(site *Site, o *origin, response *http.Response, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		o.breaker.release()
+	case err != nil:
+		site.origins.fail(o, err)
+	case response.StatusCode == http.StatusBadGateway || response.StatusCode == http.StatusServiceUnavailable || response.StatusCode == http.StatusGatewayTimeout:
+		site.origins.fail(o, fmt.Errorf("状态码 %d", response.StatusCode))
+	default:
+		site.origins.succeed(o)
+	}
+}
@@ -0,0 +1,95 @@
+package frontend
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"seo/mirror/db"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestOriginHostOverride(t *testing.T) {
+	hosts := make(map[string][]string)
+	newOrigin := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hosts[name] = append(hosts[name], r.Host)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte(`<html><head><title>t</title></head><body><a href="http://www.primary.test/a">` + name + `</a></body></html>`))
+		}))
+	}
+	first, second := newOrigin("first"), newOrigin("second")
+	defer first.Close()
+	defer second.Close()
+	f := newTestFrontend(t, &db.SiteConfig{
+		Domain:     "example.com",
+		Url:        "http://www.primary.test",
+		Origins:    []string{first.URL + ",host=www.primary.test", second.URL},
+		IndexTitle: "t",
+	})
+	for i := 0; i < 4; i++ {
+		response := serve(f, "http://www.example.com/page"+strconv.Itoa(i))
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("状态码 %d", response.StatusCode)
+		}
+		if strings.Contains(string(body), "primary.test") {
+			t.Fatalf("内容中还有源站域名:%s", body)
+		}
+	}
+	want := map[string]string{"first": "www.primary.test", "second": strings.TrimPrefix(second.URL, "http://")}
+	for name, host := range want {
+		if len(hosts[name]) != 2 {
+			t.Fatalf("%s 收到 %d 个请求", name, len(hosts[name]))
+		}
+		for _, got := range hosts[name] {
+			if got != host {
+				t.Fatalf("%s 收到的 Host 为 %s，应为 %s", name, got, host)
+			}
+		}
+	}
+	value, _ := f.Sites.Load("example.com")
+	site := value.(*Site)
+	for _, o := range site.origins.origins {
+		serverName := ""
+		if tlsConfig := f.transport(site, o).TLSClientConfig; tlsConfig != nil {
+			serverName = tlsConfig.ServerName
+		}
+		if o.host != "" && serverName != "www.primary.test" || o.host == "" && serverName != "" {
+			t.Errorf("%s 的 ServerName 为 %q", o.url, serverName)
+		}
+	}
+}
+
+func TestNewOriginPool(t *testing.T) {
+	primary, _ := url.Parse("https://www.primary.test")
+	cases := []struct {
+		item   string
+		weight int
+		host   string
+		err    bool
+	}{
+		{"https://1.2.3.4", 1, "", false},
+		{"https://1.2.3.4=3", 3, "", false},
+		{"https://1.2.3.4=3,host=www.primary.test", 3, "www.primary.test", false},
+		{"https://1.2.3.4,host=www.primary.test:8443", 1, "www.primary.test:8443", false},
+		{"https://1.2.3.4=0", 0, "", true},
+		{"https://1.2.3.4,sni=a.test", 0, "", true},
+		{"1.2.3.4", 0, "", true},
+	}
+	for _, c := range cases {
+		pool, err := newOriginPool(primary, []string{c.item}, BalanceRoundRobin, "", 0)
+		if (err != nil) != c.err {
+			t.Errorf("%s 的错误为 %v", c.item, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if o := pool.origins[0]; o.weight != c.weight || o.host != c.host {
+			t.Errorf("%s 解析为权重 %d，Host %q", c.item, o.weight, o.host)
+		}
+	}
+}
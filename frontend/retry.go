@@ -0,0 +1,264 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 可以重试的网络错误类型
+const (
+	RetryConnect = "connect"
+	RetryReset   = "reset"
+	RetryTimeout = "timeout"
+)
+
+// retryBudgetMax 重试预算的上限，也是站点刚启用时的预算，流量小的站点也能重试几次
+const retryBudgetMax = 10
+
+// retryMaxBackoff 两次尝试之间最长的等待时间
+const retryMaxBackoff = 5 * time.Second
+
+var defaultRetryStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+var defaultRetryErrors = []string{RetryConnect, RetryReset}
+
+// retryPolicy 站点 GET、HEAD 回源的重试策略
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+	statuses []int
+	errors   []string
+	budget   *retryBudget
+	stats    retryStats
+}
+
+// retryBudget 每个请求按比例存入预算，每次重试用掉一个，源站大面积故障时重试不会成倍放大回源量
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	ratio  float64
+}
+
+type retryStats struct {
+	retries   atomic.Int64
+	recovered atomic.Int64
+	exhausted atomic.Int64
+	denied    atomic.Int64
+}
+
+// RetryStats 重试统计
+type RetryStats struct {
+	Retries   int64 `json:"retries"`
+	Recovered int64 `json:"recovered"`
+	Exhausted int64 `json:"exhausted"`
+	Denied    int64 `json:"denied"`
+}
+
+func (stats RetryStats) String() string {
+	return fmt.Sprintf("重试%d次，重试后成功%d次，重试后仍失败%d次，预算不足%d次", stats.Retries, stats.Recovered, stats.Exhausted, stats.Denied)
+}
+
+// newRetryPolicy attempts 为包括第一次在内的最多尝试次数，小于 2 时不重试。backoff 单位毫秒，默认 100，
+// budget 为重试数占请求数的最大比例，单位%，默认 20
+func newRetryPolicy(attempts int, backoff int64, statuses, errorTypes []string, budget int) (*retryPolicy, error) {
+	policy := &retryPolicy{
+		attempts: max(attempts, 1),
+		backoff:  time.Duration(backoff) * time.Millisecond,
+		statuses: defaultRetryStatuses,
+		errors:   defaultRetryErrors,
+	}
+	if policy.backoff <= 0 {
+		policy.backoff = 100 * time.Millisecond
+	}
+	if budget <= 0 {
+		budget = 20
+	}
+	policy.budget = &retryBudget{tokens: retryBudgetMax, ratio: float64(budget) / 100}
+	if len(statuses) > 0 {
+		policy.statuses = make([]int, 0, len(statuses))
+		for _, item := range statuses {
+			code, err := strconv.Atoi(strings.TrimSpace(item))
+			if err != nil || code < 100 || code > 599 {
+				return nil, fmt.Errorf("重试状态码错误:%s", item)
+			}
+			policy.statuses = append(policy.statuses, code)
+		}
+	}
+	if len(errorTypes) > 0 {
+		policy.errors = make([]string, 0, len(errorTypes))
+		for _, item := range errorTypes {
+			item = strings.ToLower(strings.TrimSpace(item))
+			if item != RetryConnect && item != RetryReset && item != RetryTimeout {
+				return nil, fmt.Errorf("重试错误类型错误:%s", item)
+			}
+			policy.errors = append(policy.errors, item)
+		}
+	}
+	return policy, nil
+}
+
+func (budget *retryBudget) deposit() {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	budget.tokens = min(budget.tokens+budget.ratio, retryBudgetMax)
+}
+
+func (budget *retryBudget) withdraw() bool {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	if budget.tokens < 1 {
+		return false
+	}
+	budget.tokens--
+	return true
+}
+
+// refund 取得预算后没有重试时退回
+func (budget *retryBudget) refund() {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	budget.tokens = min(budget.tokens+1, retryBudgetMax)
+}
+
+// retryable 返回需要重试的原因，不需要重试时返回空
+func (policy *retryPolicy) retryable(response *http.Response, err error) string {
+	if err == nil {
+		if slices.Contains(policy.statuses, response.StatusCode) {
+			return "状态码 " + strconv.Itoa(response.StatusCode)
+		}
+		return ""
+	}
+	if errType := retryErrorType(err); errType != "" && slices.Contains(policy.errors, errType) {
+		return err.Error()
+	}
+	return ""
+}
+
+func retryErrorType(err error) string {
+	var opErr *net.OpError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return RetryConnect
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return RetryReset
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return RetryTimeout
+	}
+	return ""
+}
+
+// delay 第 attempt 次失败后的等待时间，指数增长，在一半到全部之间随机
+func (policy *retryPolicy) delay(attempt int) time.Duration {
+	backoff := min(policy.backoff<<(attempt-1), retryMaxBackoff)
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+func (policy *retryPolicy) Stats() RetryStats {
+	return RetryStats{
+		Retries:   policy.stats.retries.Load(),
+		Recovered: policy.stats.recovered.Load(),
+		Exhausted: policy.stats.exhausted.Load(),
+		Denied:    policy.stats.denied.Load(),
+	}
+}
+
+// RetryStats 返回站点的重试统计
+func (f *Frontend) RetryStats(domain string) (RetryStats, bool) {
+	value, ok := f.Sites.Load(domain)
+	if !ok {
+		return RetryStats{}, false
+	}
+	return value.(*Site).retry.Stats(), true
+}
+
+// roundTrip 按站点的重试策略回源，每次尝试的结果都计入源站熔断器。重试时优先换一个源站，
+// 没有可用的源站、预算用完或请求已经取消时不再重试。带正文且不能重新读取正文的请求不重试
+func (t *originTransport) roundTrip(site *Site, o *origin, request *http.Request) (*http.Response, error) {
+	policy := site.retry
+	idempotent := (request.Method == http.MethodGet || request.Method == http.MethodHead) &&
+		(request.Body == nil || request.Body == http.NoBody || request.GetBody != nil)
+	if idempotent {
+		policy.budget.deposit()
+	}
+	for attempt := 1; ; attempt++ {
+		response, err := t.RoundTripper.RoundTrip(request)
+		t.record(site, o, response, err)
+		reason := ""
+		if idempotent && attempt < policy.attempts && request.Context().Err() == nil {
+			reason = policy.retryable(response, err)
+		}
+		if reason == "" {
+			if attempt > 1 {
+				if err == nil && policy.retryable(response, nil) == "" {
+					policy.stats.recovered.Add(1)
+				} else {
+					policy.stats.exhausted.Add(1)
+				}
+			}
+			return response, err
+		}
+		if !policy.budget.withdraw() {
+			policy.stats.denied.Add(1)
+			return response, err
+		}
+		next := site.origins.pickExcept(o)
+		if next == nil {
+			policy.budget.refund()
+			return response, err
+		}
+		if request.GetBody != nil {
+			body, bodyErr := request.GetBody()
+			if bodyErr != nil {
+				next.breaker.release()
+				policy.budget.refund()
+				return response, err
+			}
+			request.Body = body
+		}
+		if response != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+			_ = response.Body.Close()
+		}
+		delay := policy.delay(attempt)
+		policy.stats.retries.Add(1)
+		slog.Warn("回源重试", "domain", site.Domain, "url", request.URL.String(), "attempt", attempt+1, "delay", delay.String(), "message", reason)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-request.Context().Done():
+			timer.Stop()
+			next.breaker.release()
+			return nil, context.Cause(request.Context())
+		}
+		request = retarget(request, o, next)
+		o = next
+	}
+}
+
+// retarget 把发往 from 的请求改为发往 to，连接池按上下文中的源站选择
+func retarget(request *http.Request, from, to *origin) *http.Request {
+	request = request.WithContext(context.WithValue(request.Context(), Origin, to))
+	u := *request.URL
+	u.Scheme, u.Host = to.url.Scheme, to.url.Host
+	if from.url.Path != to.url.Path {
+		u.Path = strings.TrimSuffix(to.url.Path, "/") + strings.TrimPrefix(u.Path, strings.TrimSuffix(from.url.Path, "/"))
+		u.RawPath = ""
+	}
+	request.URL = &u
+	request.Host = to.host
+	return request
+}
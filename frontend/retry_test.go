@@ -0,0 +1,43 @@
+package frontend
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"seo/mirror/db"
+	"strconv"
+	"testing"
+)
+
+func TestRetryOnAnotherOrigin(t *testing.T) {
+	hits := make(map[string]int)
+	newOrigin := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[name]++
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(name))
+		}))
+	}
+	bad, good := newOrigin("bad", http.StatusBadGateway), newOrigin("good", http.StatusOK)
+	defer bad.Close()
+	defer good.Close()
+	f := newTestFrontend(t, &db.SiteConfig{
+		Domain:        "example.com",
+		Url:           "http://www.primary.test",
+		Origins:       []string{bad.URL, good.URL},
+		RetryAttempts: 2,
+		RetryBackoff:  1,
+	})
+	//轮询时总有一个请求先发到出错的源站，重试必须换到另一个源站
+	for i := 0; i < 2; i++ {
+		response := serve(f, "http://www.example.com/file"+strconv.Itoa(i)+".txt")
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != http.StatusOK || string(body) != "good" {
+			t.Fatalf("状态码 %d，内容 %q", response.StatusCode, body)
+		}
+	}
+	if hits["bad"] != 1 || hits["good"] != 2 {
+		t.Fatalf("出错的源站收到 %d 次请求，正常的源站收到 %d 次", hits["bad"], hits["good"])
+	}
+}
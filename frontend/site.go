@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"golang.org/x/net/html"
@@ -11,7 +12,9 @@ import (
 	"math/rand/v2"
 	"net/http"
 	"net/url"
+	"path"
 	"regexp"
+	"seo/mirror/cache"
 	"seo/mirror/config"
 	"seo/mirror/db"
 	"seo/mirror/helper"
@@ -19,32 +22,26 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Site struct {
 	*db.SiteConfig
 	targetUrl *url.URL
+	Store     cache.Store
+	//配置的摘要，修改配置后替换结果会变，ETag 也要跟着变
+	version string
+	rules   []cacheRule
+	origins *originPool
+	retry   *retryPolicy
 }
 
-type CacheResponse struct {
-	StatusCode int
-	Body       []byte
-	Header     http.Header
-	RandomHtml string
+// cacheRule 按内容类型或路径设置的缓存时间，pattern 以 / 开头时匹配路径
+type cacheRule struct {
+	pattern string
+	ttl     time.Duration
 }
 
-func (cr *CacheResponse) free() {
-	cr.Header = make(http.Header)
-	if cap(cr.Body) > 1<<20 {
-		cr.Body = nil
-	} else {
-		cr.Body = cr.Body[:0]
-	}
-}
-
-var cachePool = sync.Pool{New: func() any {
-	return new(CacheResponse)
-}}
 var bufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
 var needIdAttrTags = []string{"address", "th", "tfoot", "tbody", "pre", "legend", "form", "h5", "h6", "h4", "h3", "h2", "h1", "dd", "dl", "dt", "fieldset", "caption", "div", "ol", "ul", "li", "p", "table", "tr", "td", "article", "aside", "nav", "header", "main", "section", "footer", "hgroup"}
 var chineseRegexp = regexp.MustCompile("[\u4e00-\u9fa5]+")
@@ -72,11 +69,328 @@ func NewSite(siteConfig *db.SiteConfig) (*Site, error) {
 	if siteConfig.H1Replace != "" {
 		siteConfig.H1Replace = helper.HtmlEntities(siteConfig.H1Replace)
 	}
+	isBlank := func(s string) bool { return strings.TrimSpace(s) == "" }
+	siteConfig.KeyIgnoreParams = slices.DeleteFunc(siteConfig.KeyIgnoreParams, isBlank)
+	siteConfig.KeyAllowParams = slices.DeleteFunc(siteConfig.KeyAllowParams, isBlank)
+	siteConfig.VaryDimensions = slices.DeleteFunc(siteConfig.VaryDimensions, isBlank)
+	for i, dimension := range siteConfig.VaryDimensions {
+		dimension = strings.TrimSpace(dimension)
+		if lower := strings.ToLower(dimension); lower == "device" || lower == "language" {
+			siteConfig.VaryDimensions[i] = lower
+		} else {
+			siteConfig.VaryDimensions[i] = http.CanonicalHeaderKey(dimension)
+		}
+	}
+	for _, pattern := range append(slices.Clone(siteConfig.KeyIgnoreParams), siteConfig.KeyAllowParams...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Join(fmt.Errorf("缓存参数规则错误:%s", pattern), err)
+		}
+	}
+	siteConfig.Origins = slices.DeleteFunc(siteConfig.Origins, isBlank)
+	origins, err := newOriginPool(u, siteConfig.Origins, siteConfig.OriginBalance, siteConfig.HealthPath, siteConfig.HealthInterval)
+	if err != nil {
+		return nil, err
+	}
+	siteConfig.OriginEncoding = strings.TrimSpace(siteConfig.OriginEncoding)
+	if siteConfig.OriginEncoding != "" {
+		if err := checkOriginEncoding(siteConfig.OriginEncoding); err != nil {
+			return nil, err
+		}
+	}
+	if siteConfig.EgressProxy != "" && siteConfig.EgressProxy != helper.ProxyDirect {
+		if _, err := helper.ParseProxy(siteConfig.EgressProxy); err != nil {
+			return nil, err
+		}
+	}
+	siteConfig.RetryStatuses = slices.DeleteFunc(siteConfig.RetryStatuses, isBlank)
+	siteConfig.RetryErrors = slices.DeleteFunc(siteConfig.RetryErrors, isBlank)
+	retry, err := newRetryPolicy(siteConfig.RetryAttempts, siteConfig.RetryBackoff, siteConfig.RetryStatuses, siteConfig.RetryErrors, siteConfig.RetryBudget)
+	if err != nil {
+		return nil, err
+	}
+	siteConfig.CacheRules = slices.DeleteFunc(siteConfig.CacheRules, isBlank)
+	rules, err := parseCacheRules(siteConfig.CacheRules)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := cache.Open(siteConfig.CacheStore)
+	if err != nil {
+		return nil, errors.Join(errors.New("缓存类型错误"), err)
+	}
+	cache.SetDomainLimit(siteConfig.Domain, siteConfig.CacheLimit<<20)
 
-	site := &Site{SiteConfig: siteConfig, targetUrl: u}
+	site := &Site{SiteConfig: siteConfig, targetUrl: u, Store: store, rules: rules, origins: origins, retry: retry}
+	configJson, err := json.Marshal(siteConfig)
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(configJson)
+	site.version = hex.EncodeToString(sum[:4])
 
 	return site, nil
 }
+
+// cacheKey 按站点规则生成缓存键，没有配置规则时和原来的键一致
+func (site *Site) cacheKey(u *url.URL) string {
+	requestPath := u.Path
+	if site.KeyFoldCase {
+		requestPath = strings.ToLower(requestPath)
+	}
+	if site.KeyTrimSlash && len(requestPath) > 1 {
+		requestPath = strings.TrimRight(requestPath, "/")
+	}
+	rawQuery := u.RawQuery
+	if rawQuery != "" && (len(site.KeyIgnoreParams) > 0 || len(site.KeyAllowParams) > 0 || site.KeySortParams) {
+		params := make([]string, 0)
+		for _, param := range strings.Split(rawQuery, "&") {
+			name, _, _ := strings.Cut(param, "=")
+			if unescaped, err := url.QueryUnescape(name); err == nil {
+				name = unescaped
+			}
+			if param == "" || !site.keepParam(name) {
+				continue
+			}
+			params = append(params, param)
+		}
+		if site.KeySortParams {
+			//按参数名排序，同名参数保持原来的顺序
+			slices.SortStableFunc(params, func(a, b string) int {
+				nameA, _, _ := strings.Cut(a, "=")
+				nameB, _, _ := strings.Cut(b, "=")
+				return strings.Compare(nameA, nameB)
+			})
+		}
+		rawQuery = strings.Join(params, "&")
+	}
+	return site.Domain + requestPath + rawQuery
+}
+
+func (site *Site) keepParam(name string) bool {
+	matchAny := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(site.KeyAllowParams) > 0 && !matchAny(site.KeyAllowParams) {
+		return false
+	}
+	return !matchAny(site.KeyIgnoreParams)
+}
+
+// varyFields 合并站点配置的变体维度和源站的 Vary 头，源站返回 Vary: * 时不缓存
+func (site *Site) varyFields(header http.Header) ([]string, bool) {
+	fields := slices.Clone(site.VaryDimensions)
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			field = http.CanonicalHeaderKey(strings.TrimSpace(field))
+			switch field {
+			case "":
+			case "*":
+				return nil, false
+			case "Accept-Encoding":
+				//缓存的是解压后的内容，不需要按编码区分
+			default:
+				if !slices.Contains(fields, field) {
+					fields = append(fields, field)
+				}
+			}
+		}
+	}
+	return fields, true
+}
+
+// addVary 把站点的变体维度对应的请求头加到 Vary 中，下游缓存才能区分
+func (site *Site) addVary(header http.Header) {
+	for _, dimension := range site.VaryDimensions {
+		field := dimension
+		switch dimension {
+		case "device":
+			field = "User-Agent"
+		case "language":
+			field = "Accept-Language"
+		}
+		if !slices.ContainsFunc(header.Values("Vary"), func(value string) bool {
+			return strings.Contains(strings.ToLower(value), strings.ToLower(field))
+		}) {
+			header.Add("Vary", field)
+		}
+	}
+}
+
+// variant 请求在各个变体字段上的取值
+func (site *Site) variant(request *http.Request, fields []string) string {
+	values := make([]string, 0, len(fields))
+	for _, field := range fields {
+		values = append(values, field+"="+varyValue(request, field))
+	}
+	return strings.Join(values, "&")
+}
+
+func varyValue(request *http.Request, field string) string {
+	switch field {
+	case "device", "User-Agent":
+		//回源时 User-Agent 会被替换，用客户端原始的。按原始字符串区分时每个浏览器版本都是一个变体，只按设备类型区分
+		if helper.IsMobile(request.Context().Value(OriginUA).(string)) {
+			return "mobile"
+		}
+		return "desktop"
+	case "language":
+		language, _, _ := strings.Cut(request.Header.Get("Accept-Language"), ",")
+		language, _, _ = strings.Cut(language, ";")
+		return strings.ToLower(strings.TrimSpace(language))
+	}
+	return request.Header.Get(field)
+}
+
+// parseCacheRules 规则格式为 匹配=时间，例如 text/html=10m、image/*=168h、/static/=24h。
+// 内容类型和路径都支持 * 通配，路径以 / 结尾时匹配这个目录下的所有地址
+func parseCacheRules(items []string) ([]cacheRule, error) {
+	rules := make([]cacheRule, 0, len(items))
+	for _, item := range items {
+		index := strings.LastIndex(item, "=")
+		if index <= 0 {
+			return nil, fmt.Errorf("缓存规则错误:%s", item)
+		}
+		pattern := strings.ToLower(strings.TrimSpace(item[:index]))
+		ttl, err := time.ParseDuration(strings.TrimSpace(item[index+1:]))
+		if err != nil || ttl < 0 {
+			return nil, errors.Join(fmt.Errorf("缓存规则时间错误:%s", item), err)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Join(fmt.Errorf("缓存规则错误:%s", item), err)
+		}
+		rules = append(rules, cacheRule{pattern: pattern, ttl: ttl})
+	}
+	return rules, nil
+}
+
+func (rule cacheRule) match(requestPath, contentType string) bool {
+	if !strings.HasPrefix(rule.pattern, "/") {
+		ok, _ := path.Match(rule.pattern, contentType)
+		return ok
+	}
+	if strings.HasSuffix(rule.pattern, "/") {
+		return strings.HasPrefix(requestPath, rule.pattern)
+	}
+	ok, _ := path.Match(rule.pattern, requestPath)
+	return ok
+}
+
+// cacheTTL 按规则顺序匹配请求路径和内容类型，都不匹配时使用站点的缓存时间
+func (site *Site) cacheTTL(requestPath string, header http.Header) time.Duration {
+	if len(site.rules) > 0 {
+		requestPath = strings.ToLower(requestPath)
+		contentType, _, _ := strings.Cut(header.Get("Content-Type"), ";")
+		contentType = strings.ToLower(strings.TrimSpace(contentType))
+		for _, rule := range site.rules {
+			if rule.match(requestPath, contentType) {
+				return rule.ttl
+			}
+		}
+	}
+	return time.Duration(site.CacheTime) * time.Hour
+}
+
+// metaTTL 变体标记没有内容类型，使用最长的缓存时间，避免先于变体被清理。错误缓存按错误缓存时间，不按规则
+func (site *Site) metaTTL(meta *cache.Meta) time.Duration {
+	if meta.IsMarker() {
+		return site.expiry().Max
+	}
+	if meta.StatusCode != 0 && meta.StatusCode != http.StatusOK {
+		return site.negativeTTL(meta.StatusCode)
+	}
+	return site.cacheTTL(site.metaPath(meta), meta.Header)
+}
+
+// metaPath 缓存对应的请求路径。旧缓存没有记录路径，从缓存键中取，带参数时不准确
+func (site *Site) metaPath(meta *cache.Meta) string {
+	if meta.Path != "" {
+		return meta.Path
+	}
+	requestPath, _, _ := strings.Cut(strings.TrimPrefix(meta.Key, site.Domain), "#")
+	return requestPath
+}
+
+// expiry 供过期缓存清理使用的缓存时间范围
+func (site *Site) expiry() cache.Expiry {
+	ttl := time.Duration(site.CacheTime) * time.Hour
+	expiry := cache.Expiry{Min: ttl, Max: ttl}
+	for _, rule := range site.rules {
+		expiry.Min = min(expiry.Min, rule.ttl)
+		expiry.Max = max(expiry.Max, rule.ttl)
+	}
+	//错误缓存的时间通常比正常缓存短得多，需要读取缓存头判断
+	for _, statusCode := range []int{http.StatusNotFound, http.StatusInternalServerError} {
+		if ttl := site.negativeTTL(statusCode); ttl > 0 {
+			expiry.Min = min(expiry.Min, ttl)
+		}
+	}
+	expiry.TTL = site.metaTTL
+	//过期后还在 stale_while_revalidate 时间内的缓存仍会输出，不能清理
+	expiry.Grace = time.Duration(site.StaleTime) * time.Minute
+	return expiry
+}
+
+// originEncoding 回源时的 Accept-Encoding
+func (site *Site) originEncoding() string {
+	if site.OriginEncoding == "" {
+		return defaultOriginEncoding
+	}
+	return site.OriginEncoding
+}
+
+// expires 缓存的过期时间，遵循源站缓存头时优先使用写入缓存时计算好的时间
+func (site *Site) expires(meta *cache.Meta) time.Time {
+	if site.OriginCache && !meta.Expires.IsZero() {
+		return meta.Expires
+	}
+	return meta.Created.Add(site.metaTTL(meta))
+}
+
+// negativeTTL 源站错误响应的缓存时间，404、410 和 5xx 分别配置，为 0 时不缓存
+func (site *Site) negativeTTL(statusCode int) time.Duration {
+	switch {
+	case statusCode == http.StatusNotFound || statusCode == http.StatusGone:
+		return time.Duration(site.NotFoundTime) * time.Minute
+	case statusCode >= 500:
+		return time.Duration(site.ErrorTime) * time.Minute
+	}
+	return 0
+}
+
+// etag 生成缓存响应的 ETag，替换后的内容和访问的域名、协议有关，需要一起计算。
+// html 中有随机内容，只保证语义相同，使用弱 ETag
+func (site *Site) etag(meta *cache.Meta, scheme, requestHost string, isSpider bool) string {
+	sum := md5.Sum([]byte(fmt.Sprintf("%s|%d|%d|%s|%s|%t|%s", meta.Key, meta.Created.UnixNano(), meta.Checksum, scheme, requestHost, isSpider, site.version)))
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	if strings.Contains(strings.ToLower(meta.Header.Get("Content-Type")), "text/html") {
+		etag = "W/" + etag
+	}
+	return etag
+}
+
+// validators 根据缓存中源站的 ETag 和 Last-Modified 生成条件请求头
+func (site *Site) validators(header http.Header) http.Header {
+	if !site.OriginCache {
+		return nil
+	}
+	validators := make(http.Header)
+	if etag := header.Get("ETag"); etag != "" {
+		validators.Set("If-None-Match", etag)
+	}
+	if lastModified := header.Get("Last-Modified"); lastModified != "" {
+		validators.Set("If-Modified-Since", lastModified)
+	}
+	if len(validators) == 0 {
+		return nil
+	}
+	return validators
+}
+
 func (site *Site) handleHtmlResponse(document *html.Node, scheme, requestHost, requestPath, randomHtml string, isIndexPage, isSpider bool, buffer *bytes.Buffer) ([]byte, error) {
 	site.handleHtmlNode(document, scheme, requestHost, requestPath, isIndexPage)
 	err := html.Render(buffer, document)
@@ -391,6 +705,12 @@ func (site *Site) transformMetaNode(node *html.Node, isIndexPage bool) {
 
 func (site *Site) replaceHost(content []byte, scheme, requestHost string) []byte {
 	originHost := site.targetUrl.Host
+	//其他源站的域名和主源站一样替换成访问的域名
+	for _, o := range site.origins.origins {
+		if o.url.Host != originHost {
+			content = bytes.ReplaceAll(content, []byte(o.url.Host), []byte(requestHost))
+		}
+	}
 	content = bytes.ReplaceAll(content, []byte(originHost), []byte(requestHost))
 	if scheme == "https" {
 		content = bytes.ReplaceAll(content, []byte("http://"+requestHost), []byte("https://"+requestHost))
@@ -0,0 +1,72 @@
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"seo/mirror/db"
+	"testing"
+	"time"
+)
+
+func TestCacheRulesMatchPathWithQuery(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte("<html><head><title>t</title></head><body>" + r.URL.RequestURI() + "</body></html>"))
+	}))
+	defer origin.Close()
+	f := newTestFrontend(t, &db.SiteConfig{
+		Domain:      "example.com",
+		Url:         origin.URL,
+		CacheEnable: true,
+		CacheTime:   1,
+		IndexTitle:  "t",
+		CacheRules:  []string{"/*.html=10m", "/index.php=5m"},
+	})
+	value, _ := f.Sites.Load("example.com")
+	site := value.(*Site)
+	cases := []struct {
+		target string
+		ttl    time.Duration
+	}{
+		{"/list.html", 10 * time.Minute},
+		{"/list.html?page=2", 10 * time.Minute},
+		{"/index.php?id=1", 5 * time.Minute},
+		{"/other?x=1", time.Hour},
+	}
+	for _, c := range cases {
+		_ = serve(f, "http://www.example.com"+c.target)
+		u, _ := url.Parse(c.target)
+		reader, err := site.Store.Open(site.Domain, site.cacheKey(u))
+		if err != nil {
+			t.Fatalf("%s 没有写入缓存:%v", c.target, err)
+		}
+		if ttl := site.metaTTL(&reader.Meta); ttl != c.ttl {
+			t.Errorf("%s 的缓存时间为 %s，应为 %s", c.target, ttl, c.ttl)
+		}
+		_ = reader.Close()
+	}
+}
+
+func TestNewSiteKeepsClonedConfig(t *testing.T) {
+	siteConfig := db.SiteConfig{
+		Domain:          "example.com",
+		Url:             "http://origin.test",
+		KeyIgnoreParams: []string{"", "utm_*"},
+		VaryDimensions:  []string{" ", "accept-language"},
+		CacheRules:      []string{"", "/*.html=10m"},
+		Origins:         []string{"", "http://origin.test=2"},
+		RetryStatuses:   []string{"", "502"},
+		RetryErrors:     []string{"", "reset"},
+	}
+	//保存的是提交的原始配置，NewSite 去掉空项和规范化字段时不能改到它
+	raw, want := siteConfig.Clone(), siteConfig.Clone()
+	_ = newTestFrontend(t, &siteConfig)
+	if !reflect.DeepEqual(raw, want) {
+		t.Fatalf("NewSite 修改了原始配置:%+v", raw)
+	}
+	if len(siteConfig.Origins) != 1 || siteConfig.VaryDimensions[0] != "Accept-Language" {
+		t.Fatalf("NewSite 没有处理配置:%v %v", siteConfig.Origins, siteConfig.VaryDimensions)
+	}
+}
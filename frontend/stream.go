@@ -0,0 +1,158 @@
+package frontend
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"seo/mirror/cache"
+	"seo/mirror/config"
+	"strings"
+)
+
+// shouldStream 不需要替换内容的大文件边下载边输出，不读入内存。需要替换的 html、css、js 读入内存处理，
+// 配置的 stream_types 总是边下载边输出。长度未知、没有压缩但可以压缩的内容先读入不超过 stream_size 的部分，
+// 读完了按小文件处理，超过时读到的部分接回正文边下载边输出
+func shouldStream(response *http.Response) (bool, error) {
+	contentType := strings.ToLower(response.Header.Get("Content-Type"))
+	if strings.Contains(contentType, "text/html") || strings.Contains(contentType, "css") || strings.Contains(contentType, "javascript") {
+		return false, nil
+	}
+	for _, streamType := range config.Conf.StreamTypes {
+		if streamType != "" && strings.HasPrefix(contentType, strings.ToLower(streamType)) {
+			return true, nil
+		}
+	}
+	if response.ContentLength >= 0 {
+		return response.ContentLength > streamSize(), nil
+	}
+	if isEncoded(response.Header.Get("Content-Encoding")) || !cache.Compressible(contentType) {
+		return true, nil
+	}
+	limit := int(streamSize())
+	buffered := bufio.NewReaderSize(response.Body, limit+1)
+	_, err := buffered.Peek(limit + 1)
+	response.Body = &peekedBody{Reader: buffered, Closer: response.Body}
+	if errors.Is(err, io.EOF) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// peekedBody 预读过的正文，读取预读的缓冲区，关闭原来的正文
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+func isEncoded(contentEncoding string) bool {
+	return contentEncoding != "" && !strings.EqualFold(contentEncoding, "identity")
+}
+
+func streamSize() int64 {
+	size := config.Conf.StreamSize
+	if size <= 0 {
+		size = 1024
+	}
+	return size << 10
+}
+
+// streamResponse 正文原样输出给客户端，同时写入缓存。完整读完才提交，客户端中途断开时丢弃。
+// release 在提交或丢弃缓存后调用，不写缓存时直接调用
+func (f *Frontend) streamResponse(site *Site, response *http.Response, cacheKey string, release func()) error {
+	var tee *teeBody
+	defer func() {
+		if tee == nil {
+			release()
+		}
+	}()
+	//压缩的正文解压后写入缓存，缓存的正文可以按 Range 读取
+	contentEncoding := strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding")))
+	if isEncoded(contentEncoding) {
+		err := decodeBody(response, contentEncoding)
+		if err != nil {
+			return err
+		}
+	}
+	maxSize := site.MaxCacheSize << 20
+	cacheable := site.CacheEnable && response.Request.Method == http.MethodGet &&
+		(maxSize == 0 || response.ContentLength <= maxSize)
+	var entry *cache.Response
+	var vary []string
+	if cacheable {
+		entry, vary = f.newEntry(site, response.Request.URL.Path, response.StatusCode, response.Header, "")
+	}
+	if entry != nil {
+		//提交前头信息还会被修改，缓存保存一份副本
+		entry.Header = response.Header.Clone()
+		entry.Header.Del("Content-Length")
+	}
+	//正文读完才知道校验值，这次输出不带 ETag
+	f.setValidators(response, site, nil)
+	if entry != nil {
+		writer, err := cache.NewWriter(site.Store, site.Domain, cacheKey, entry.Meta, vary, site.variant(response.Request, vary), maxSize)
+		if err != nil {
+			slog.Error("创建缓存临时文件失败", "message", err.Error())
+		} else {
+			tee = &teeBody{ReadCloser: response.Body, writer: writer, key: cacheKey, expected: response.ContentLength, release: release}
+			response.Body = tee
+		}
+	}
+	return nil
+}
+
+// teeBody 把输出给客户端的正文同时写入缓存
+type teeBody struct {
+	io.ReadCloser
+	writer   *cache.Writer
+	key      string
+	expected int64
+	written  int64
+	done     bool
+	//提交或丢弃缓存后通知等待的请求
+	release func()
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 && !t.done {
+		_, writeErr := t.writer.Write(p[:n])
+		t.written += int64(n)
+		if writeErr != nil {
+			t.abort(writeErr)
+		}
+	}
+	if errors.Is(err, io.EOF) && !t.done {
+		if t.expected >= 0 && t.written != t.expected {
+			t.abort(io.ErrUnexpectedEOF)
+		} else {
+			t.done = true
+			commitErr := t.writer.Commit()
+			t.release()
+			if commitErr != nil && !errors.Is(commitErr, cache.ErrTooManyVariants) {
+				slog.Error("写入缓存失败", "key", t.key, "message", commitErr.Error())
+			}
+		}
+	}
+	return n, err
+}
+
+func (t *teeBody) Close() error {
+	if !t.done {
+		t.done = true
+		t.writer.Abort()
+		t.release()
+	}
+	return t.ReadCloser.Close()
+}
+
+// abort 超过最大缓存大小是正常情况，不记录日志
+func (t *teeBody) abort(err error) {
+	t.done = true
+	t.writer.Abort()
+	t.release()
+	if !errors.Is(err, cache.ErrTooLarge) {
+		slog.Error("写入缓存失败", "key", t.key, "message", err.Error())
+	}
+}
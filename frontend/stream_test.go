@@ -0,0 +1,101 @@
+package frontend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"seo/mirror/cache"
+	"seo/mirror/config"
+	"seo/mirror/db"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newStreamOrigin 按路径返回不同的内容，chunked 开头的不带 Content-Length
+func newStreamOrigin(bodies map[string]string, contentTypes map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := bodies[r.URL.Path]
+		w.Header().Set("Content-Type", contentTypes[r.URL.Path])
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/gzip"):
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			_, _ = zw.Write([]byte(body))
+			_ = zw.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			_, _ = w.Write(buf.Bytes())
+		case strings.HasPrefix(r.URL.Path, "/chunked"):
+			_, _ = w.Write([]byte(body[:1]))
+			w.(http.Flusher).Flush()
+			_, _ = w.Write([]byte(body[1:]))
+		default:
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			_, _ = w.Write([]byte(body))
+		}
+	}))
+}
+
+func TestStreamRules(t *testing.T) {
+	big := strings.Repeat("0123456789abcdef", 1<<17)
+	small := strings.Repeat("0123456789abcdef", 1<<8)
+	bodies := map[string]string{"/chunked-big.txt": big, "/chunked-small.txt": small, "/small.csv": small, "/gzip-big.txt": big}
+	contentTypes := map[string]string{"/chunked-big.txt": "text/plain", "/chunked-small.txt": "text/plain", "/small.csv": "text/csv", "/gzip-big.txt": "text/plain"}
+	origin := newStreamOrigin(bodies, contentTypes)
+	defer origin.Close()
+	f := newTestFrontend(t, &db.SiteConfig{Domain: "example.com", Url: origin.URL, CacheEnable: true, CacheTime: 1})
+	config.Conf.StreamTypes = []string{"text/csv"}
+	value, _ := f.Sites.Load("example.com")
+	site := value.(*Site)
+	cases := []struct {
+		path     string
+		encoding string
+	}{
+		//长度未知的大文件超过 stream_size 后边下载边输出，不压缩保存
+		{"/chunked-big.txt", ""},
+		//长度未知的小文件读入内存，压缩保存
+		{"/chunked-small.txt", cache.EncodingGzip},
+		//stream_types 中的类型不论大小都边下载边输出
+		{"/small.csv", ""},
+		//源站压缩的大文件解压后保存
+		{"/gzip-big.txt", ""},
+	}
+	for _, c := range cases {
+		response := serve(f, "http://www.example.com"+c.path)
+		body, _ := io.ReadAll(response.Body)
+		if string(body) != bodies[c.path] {
+			t.Fatalf("%s 输出的内容长度 %d，应为 %d", c.path, len(body), len(bodies[c.path]))
+		}
+		reader, err := site.Store.Open(site.Domain, site.Domain+c.path)
+		if err != nil {
+			t.Fatalf("%s 没有写入缓存:%v", c.path, err)
+		}
+		if reader.Encoding != c.encoding {
+			t.Errorf("%s 缓存的压缩方式为 %q，应为 %q", c.path, reader.Encoding, c.encoding)
+		}
+		_ = reader.Close()
+	}
+}
+
+func TestRangeOnCachedEntries(t *testing.T) {
+	big := strings.Repeat("0123456789abcdef", 1<<17)
+	small := strings.Repeat("0123456789abcdef", 1<<8)
+	bodies := map[string]string{"/small.txt": small, "/gzip-big.txt": big}
+	contentTypes := map[string]string{"/small.txt": "text/plain", "/gzip-big.txt": "text/plain"}
+	origin := newStreamOrigin(bodies, contentTypes)
+	defer origin.Close()
+	f := newTestFrontend(t, &db.SiteConfig{Domain: "example.com", Url: origin.URL, CacheEnable: true, CacheTime: 1})
+	for path, body := range bodies {
+		_ = serve(f, "http://www.example.com"+path)
+		request := httptest.NewRequest(http.MethodGet, "http://www.example.com"+path, nil)
+		request.Header.Set("Range", "bytes=16-31")
+		request.Header.Set("Accept-Encoding", "gzip")
+		recorder := httptest.NewRecorder()
+		f.ServeHTTP(recorder, request)
+		if got := recorder.Body.String(); recorder.Code != http.StatusPartialContent || got != body[16:32] {
+			t.Errorf("%s 的 Range 请求状态码 %d，内容长度 %d", path, recorder.Code, len(got))
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package frontend
+
+import (
+	"context"
+	"crypto/tls"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"seo/mirror/config"
+	"seo/mirror/helper"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// siteTransport 站点的回源连接，配置的摘要变化后重建
+type siteTransport struct {
+	version   string
+	transport *http.Transport
+}
+
+// transport 返回站点的回源连接，修改站点配置后关闭旧连接池的空闲连接，按新配置重建。
+// 指定了 Host 的源站 TLS 的 ServerName 不同，单独使用一个连接池
+func (f *Frontend) transport(site *Site, o *origin) *http.Transport {
+	key, serverName := site.Domain, ""
+	if o != nil && o.host != "" {
+		key, serverName = site.Domain+"|"+o.url.Host, hostname(o.host)
+	}
+	if value, ok := f.transports.Load(key); ok {
+		st := value.(*siteTransport)
+		if st.version == site.version {
+			return st.transport
+		}
+	}
+	st := &siteTransport{version: site.version, transport: f.newTransport(site, serverName)}
+	if old, loaded := f.transports.Swap(key, st); loaded {
+		old.(*siteTransport).transport.CloseIdleConnections()
+	}
+	return st.transport
+}
+
+// hostname 去掉 Host 中的端口
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// newTransport 按站点配置创建连接池，未配置的使用默认值：连接超时 30 秒，TLS 握手 10 秒，空闲连接 100 个。
+// serverName 不为空时 TLS 按这个域名握手和校验证书
+func (f *Frontend) newTransport(site *Site, serverName string) *http.Transport {
+	dialTimeout := 30 * time.Second
+	if site.DialTimeout > 0 {
+		dialTimeout = time.Duration(site.DialTimeout) * time.Second
+	}
+	tlsTimeout := 10 * time.Second
+	if site.TLSTimeout > 0 {
+		tlsTimeout = time.Duration(site.TLSTimeout) * time.Second
+	}
+	maxIdle := 100
+	if site.MaxIdleConns > 0 {
+		maxIdle = site.MaxIdleConns
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			localIp := net.IPv4(0, 0, 0, 0)
+			if len(f.IpList) > 0 {
+				ipIndex := rand.IntN(len(f.IpList))
+				localIp = f.IpList[ipIndex]
+			}
+			localAddr := &net.TCPAddr{IP: localIp, Port: 0, Zone: ""}
+			var dialer = net.Dialer{
+				LocalAddr: localAddr,
+				Timeout:   dialTimeout,
+				KeepAlive: 30 * time.Second,
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSHandshakeTimeout:   tlsTimeout,
+		ResponseHeaderTimeout: time.Duration(site.HeaderTimeout) * time.Second,
+		MaxIdleConns:          maxIdle,
+		MaxIdleConnsPerHost:   maxIdle,
+		MaxConnsPerHost:       site.MaxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     site.HTTP2,
+		Proxy:                 proxyFunc(site),
+	}
+	if serverName != "" {
+		transport.TLSClientConfig = &tls.Config{ServerName: serverName}
+	}
+	if !site.HTTP2 {
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return transport
+}
+
+// proxyFunc 站点的出口代理，站点未设置时使用全局设置，全局也未设置时读取 HTTP_PROXY、HTTPS_PROXY、NO_PROXY 环境变量。
+// 和 NO_PROXY 一样，本机地址和排除的地址直接连接。连接代理时同样使用 DialContext，绑定的出口 IP 仍然有效
+func proxyFunc(site *Site) func(*http.Request) (*url.URL, error) {
+	proxy := site.EgressProxy
+	if proxy == "" {
+		proxy = config.Conf.EgressProxy
+	}
+	if proxy == helper.ProxyDirect {
+		return nil
+	}
+	proxyConfig := httpproxy.FromEnvironment()
+	if proxy != "" {
+		proxyConfig.HTTPProxy, proxyConfig.HTTPSProxy = proxy, proxy
+	}
+	if config.Conf.NoProxy != "" {
+		proxyConfig.NoProxy = config.Conf.NoProxy
+	}
+	proxyUrl := proxyConfig.ProxyFunc()
+	return func(request *http.Request) (*url.URL, error) {
+		return proxyUrl(request.URL)
+	}
+}
+
+// siteRoundTripper 按请求所属的站点选择回源连接
+type siteRoundTripper struct {
+	f *Frontend
+}
+
+func (rt *siteRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	site, ok := request.Context().Value(SITE).(*Site)
+	if !ok {
+		return http.DefaultTransport.RoundTrip(request)
+	}
+	o, _ := request.Context().Value(Origin).(*origin)
+	return rt.f.transport(site, o).RoundTrip(request)
+}
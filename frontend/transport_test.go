@@ -0,0 +1,61 @@
+package frontend
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"seo/mirror/config"
+	"seo/mirror/db"
+	"testing"
+)
+
+// newTestProxy 模拟出口代理，记录收到的请求地址并直接返回内容，源站域名无法解析，不经过代理时请求失败
+func newTestProxy(name string) (*httptest.Server, *[]string) {
+	var urls []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		urls = append(urls, r.URL.String())
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(name))
+	}))
+	return proxy, &urls
+}
+
+func TestEgressProxy(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "")
+	t.Setenv("NO_PROXY", "")
+	global, globalUrls := newTestProxy("global")
+	defer global.Close()
+	site, siteUrls := newTestProxy("site")
+	defer site.Close()
+	cases := []struct {
+		name  string
+		proxy string
+		want  string
+		urls  *[]string
+	}{
+		{"全局代理", "", "global", globalUrls},
+		{"站点代理优先", site.URL, "site", siteUrls},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			*globalUrls, *siteUrls = nil, nil
+			f := newTestFrontend(t, &db.SiteConfig{
+				Domain:      "example.com",
+				Url:         "http://origin.test",
+				EgressProxy: c.proxy,
+			})
+			config.Conf.EgressProxy = global.URL
+			response := serve(f, "http://www.example.com/file.txt")
+			body, _ := io.ReadAll(response.Body)
+			if string(body) != c.want {
+				t.Fatalf("状态码 %d，内容 %q，应由 %s 代理返回", response.StatusCode, body, c.want)
+			}
+			if len(*c.urls) != 1 || (*c.urls)[0] != "http://origin.test/file.txt" {
+				t.Fatalf("代理收到的请求为 %v", *c.urls)
+			}
+			if len(*globalUrls)+len(*siteUrls) != 1 {
+				t.Fatalf("全局代理收到 %v，站点代理收到 %v", *globalUrls, *siteUrls)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package frontend
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"seo/mirror/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WarmRunning   = "running"
+	WarmFinished  = "finished"
+	WarmCancelled = "cancelled"
+)
+
+// 预热时最多记录的失败条数、sitemap 中最多读取的地址数和每秒最多请求数
+const (
+	warmMaxErrors   = 100
+	warmMaxUrls     = 50000
+	sitemapMaxDepth = 3
+	warmMaxRate     = 1000
+)
+
+var warmClient = &http.Client{Timeout: 30 * time.Second}
+
+// WarmProgress 预热进度
+type WarmProgress struct {
+	Domain    string    `json:"domain"`
+	State     string    `json:"state"`
+	Total     int       `json:"total"`
+	Done      int       `json:"done"`
+	Failed    int       `json:"failed"`
+	Errors    []string  `json:"errors"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+// WarmJob 预热任务，按地址列表或源站 sitemap 逐个走正常的代理流程，把页面写入缓存
+type WarmJob struct {
+	mu       sync.Mutex
+	progress WarmProgress
+	cancel   context.CancelFunc
+	finished chan struct{}
+}
+
+type sitemapDoc struct {
+	Urls     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// StartWarm 启动站点的预热任务，urls 为空时读取源站的 sitemap.xml。同一站点同时只能有一个任务
+func (f *Frontend) StartWarm(domain string, urls []string, concurrency, rate int) (*WarmJob, error) {
+	value, ok := f.Sites.Load(domain)
+	if !ok {
+		return nil, errors.New("站点不存在")
+	}
+	site := value.(*Site)
+	if concurrency <= 0 {
+		concurrency = config.Conf.WarmConcurrency
+	}
+	if rate <= 0 {
+		rate = config.Conf.WarmRate
+	}
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	if rate <= 0 {
+		rate = 10
+	}
+	if rate > warmMaxRate {
+		return nil, fmt.Errorf("每秒请求数不能超过%d", warmMaxRate)
+	}
+	f.warmMu.Lock()
+	defer f.warmMu.Unlock()
+	if old, ok := f.WarmJob(domain); ok && old.Running() {
+		return nil, errors.New("该站点已有预热任务在运行")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &WarmJob{
+		progress: WarmProgress{Domain: domain, State: WarmRunning, StartTime: time.Now()},
+		cancel:   cancel,
+		finished: make(chan struct{}),
+	}
+	f.warmJobs.Store(domain, job)
+	go func() {
+		defer cancel()
+		defer close(job.finished)
+		if len(urls) == 0 {
+			var err error
+			urls, err = f.loadSitemap(ctx, site, "/sitemap.xml", 0)
+			if err != nil {
+				job.fail("sitemap", err)
+			}
+		}
+		job.run(ctx, f, site, urls, concurrency, rate)
+	}()
+	return job, nil
+}
+
+// WarmJob 返回站点最近一次的预热任务
+func (f *Frontend) WarmJob(domain string) (*WarmJob, bool) {
+	value, ok := f.warmJobs.Load(domain)
+	if !ok {
+		return nil, false
+	}
+	return value.(*WarmJob), true
+}
+
+func (job *WarmJob) run(ctx context.Context, f *Frontend, site *Site, urls []string, concurrency, rate int) {
+	paths := make([]string, 0, len(urls))
+	for _, rawUrl := range urls {
+		rawUrl = strings.TrimSpace(rawUrl)
+		if rawUrl == "" {
+			continue
+		}
+		u, err := url.Parse(rawUrl)
+		if err != nil {
+			job.fail(rawUrl, err)
+			continue
+		}
+		//sitemap 中是源站地址，只取路径，通过镜像域名访问
+		paths = append(paths, u.RequestURI())
+	}
+	job.mu.Lock()
+	job.progress.Total = len(paths)
+	job.mu.Unlock()
+	limiter := time.NewTicker(time.Second / time.Duration(rate))
+	defer limiter.Stop()
+	tasks := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for requestUri := range tasks {
+				job.finish(requestUri, f.warmOne(ctx, site, requestUri))
+			}
+		}()
+	}
+	for _, requestUri := range paths {
+		select {
+		case <-ctx.Done():
+		case <-limiter.C:
+			select {
+			case tasks <- requestUri:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(tasks)
+	wg.Wait()
+	job.mu.Lock()
+	job.progress.EndTime = time.Now()
+	if ctx.Err() != nil {
+		job.progress.State = WarmCancelled
+	} else {
+		job.progress.State = WarmFinished
+	}
+	job.mu.Unlock()
+	progress := job.Snapshot()
+	slog.Info("缓存预热结束", "domain", progress.Domain, "state", progress.State, "total", progress.Total, "done", progress.Done, "failed", progress.Failed)
+}
+
+// warmOne 模拟一次普通访问，请求会经过缓存判断、回源和写缓存。授权过期等情况下返回 200 但不写缓存，以缓存是否存在为准
+func (f *Frontend) warmOne(ctx context.Context, site *Site, requestUri string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+site.Domain+requestUri, nil)
+	if err != nil {
+		return err
+	}
+	ua := config.Conf.UserAgent
+	if ua == "" {
+		ua = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	}
+	request.Header.Set("User-Agent", ua)
+	request.Header.Set("Accept-Encoding", "gzip")
+	writer := &discardWriter{header: make(http.Header)}
+	f.ServeHTTP(writer, request)
+	if writer.status >= 400 {
+		return fmt.Errorf("状态码 %d", writer.status)
+	}
+	if _, err = site.Store.Stat(site.Domain, site.cacheKey(request.URL)); err != nil {
+		return fmt.Errorf("状态码 %d，没有写入缓存", writer.status)
+	}
+	return nil
+}
+
+func (job *WarmJob) finish(requestUri string, err error) {
+	if err != nil {
+		job.fail(requestUri, err)
+		return
+	}
+	job.mu.Lock()
+	job.progress.Done++
+	job.mu.Unlock()
+}
+
+func (job *WarmJob) fail(requestUri string, err error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.progress.Failed++
+	if len(job.progress.Errors) < warmMaxErrors {
+		job.progress.Errors = append(job.progress.Errors, requestUri+": "+err.Error())
+	}
+}
+
+func (job *WarmJob) Running() bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.progress.State == WarmRunning
+}
+
+// Cancel 取消任务，已经发出的请求会被中断
+func (job *WarmJob) Cancel() {
+	job.cancel()
+}
+
+// Wait 等待任务结束
+func (job *WarmJob) Wait() {
+	<-job.finished
+}
+
+// Snapshot 返回当前进度的副本，用于输出
+func (job *WarmJob) Snapshot() WarmProgress {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	progress := job.progress
+	progress.Errors = append([]string(nil), job.progress.Errors...)
+	return progress
+}
+
+// String 简短的进度描述
+func (job *WarmJob) String() string {
+	snapshot := job.Snapshot()
+	state := map[string]string{WarmRunning: "预热中", WarmFinished: "预热完成", WarmCancelled: "已取消"}[snapshot.State]
+	return fmt.Sprintf("%s %d/%d 失败%d", state, snapshot.Done+snapshot.Failed, snapshot.Total, snapshot.Failed)
+}
+
+// fetchOrigin 和正常回源一样选择源站，经过熔断器和重试，requestUri 按选中的源站地址解析
+func (f *Frontend) fetchOrigin(ctx context.Context, site *Site, requestUri string) (*http.Response, error) {
+	ref, err := url.Parse(requestUri)
+	if err != nil {
+		return nil, err
+	}
+	o := site.origins.pick()
+	if o == nil {
+		return nil, errBreakerOpen
+	}
+	ctx = context.WithValue(context.WithValue(ctx, SITE, site), Origin, o)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, o.url.ResolveReference(ref).String(), nil)
+	if err != nil {
+		o.breaker.release()
+		return nil, err
+	}
+	request.Host = o.host
+	if config.Conf.UserAgent != "" {
+		request.Header.Set("User-Agent", config.Conf.UserAgent)
+	}
+	client := *warmClient
+	client.Transport = &originTransport{&siteRoundTripper{f}}
+	return client.Do(request)
+}
+
+// loadSitemap 读取 sitemap，支持 sitemap 索引和 gzip 压缩的 sitemap。索引中的地址只取路径，从源站列表中读取
+func (f *Frontend) loadSitemap(ctx context.Context, site *Site, requestUri string, depth int) ([]string, error) {
+	response, err := f.fetchOrigin(ctx, site, requestUri)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("读取 sitemap 失败，状态码 %d", response.StatusCode)
+	}
+	var body io.Reader = response.Body
+	if strings.HasSuffix(response.Request.URL.Path, ".gz") {
+		reader, err := gzip.NewReader(response.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = reader
+	}
+	var doc sitemapDoc
+	err = xml.NewDecoder(body).Decode(&doc)
+	if err != nil {
+		return nil, errors.Join(errors.New("sitemap 格式错误"), err)
+	}
+	urls := make([]string, 0, len(doc.Urls))
+	for _, item := range doc.Urls {
+		urls = append(urls, item.Loc)
+	}
+	if depth < sitemapMaxDepth {
+		for _, item := range doc.Sitemaps {
+			if len(urls) >= warmMaxUrls {
+				break
+			}
+			u, err := url.Parse(strings.TrimSpace(item.Loc))
+			if err != nil {
+				slog.Error("sitemap 地址错误", "url", item.Loc, "message", err.Error())
+				continue
+			}
+			children, err := f.loadSitemap(ctx, site, u.RequestURI(), depth+1)
+			if err != nil {
+				slog.Error("读取 sitemap 失败", "url", item.Loc, "message", err.Error())
+				continue
+			}
+			urls = append(urls, children...)
+		}
+	}
+	if len(urls) > warmMaxUrls {
+		urls = urls[:warmMaxUrls]
+	}
+	return urls, nil
+}
@@ -0,0 +1,87 @@
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"seo/mirror/db"
+	"testing"
+)
+
+func TestStartWarmRate(t *testing.T) {
+	f := newTestFrontend(t, &db.SiteConfig{Domain: "example.com", Url: "http://origin.test"})
+	cases := []struct {
+		rate int
+		ok   bool
+	}{
+		{0, true},
+		{warmMaxRate, true},
+		{warmMaxRate + 1, false},
+		{2e9, false},
+	}
+	for _, c := range cases {
+		job, err := f.StartWarm("example.com", []string{}, 1, c.rate)
+		if (err == nil) != c.ok {
+			t.Fatalf("每秒 %d 次返回 %v", c.rate, err)
+		}
+		if job != nil {
+			job.Wait()
+		}
+	}
+}
+
+func TestWarmFromSitemap(t *testing.T) {
+	var hosts []string
+	noStore := false
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			hosts = append(hosts, r.Host)
+			_, _ = w.Write([]byte(`<sitemapindex><sitemap><loc>http://www.primary.test/pages.xml</loc></sitemap></sitemapindex>`))
+		case "/pages.xml":
+			hosts = append(hosts, r.Host)
+			_, _ = w.Write([]byte(`<urlset><url><loc>http://www.primary.test/a.txt</loc></url><url><loc>http://www.primary.test/b.txt</loc></url></urlset>`))
+		default:
+			if noStore {
+				w.Header().Set("Cache-Control", "no-store")
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = w.Write([]byte("body"))
+		}
+	}))
+	defer origin.Close()
+	cases := []struct {
+		name         string
+		noStore      bool
+		done, failed int
+	}{
+		{"写入缓存", false, 2, 0},
+		//返回 200 但没有写入缓存的算失败
+		{"没有写入缓存", true, 0, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hosts, noStore = nil, c.noStore
+			//主源站的域名无法解析，sitemap 必须从源站列表中读取
+			f := newTestFrontend(t, &db.SiteConfig{
+				Domain:      "example.com",
+				Url:         "http://www.primary.test",
+				Origins:     []string{origin.URL + ",host=www.primary.test"},
+				CacheEnable: true,
+				OriginCache: true,
+				CacheTime:   1,
+			})
+			job, err := f.StartWarm("example.com", nil, 1, warmMaxRate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			job.Wait()
+			progress := job.Snapshot()
+			if progress.Total != 2 || progress.Done != c.done || progress.Failed != c.failed {
+				t.Fatalf("共 %d 条，成功 %d 条，失败 %d 条:%v", progress.Total, progress.Done, progress.Failed, progress.Errors)
+			}
+			if len(hosts) != 2 || hosts[0] != "www.primary.test" || hosts[1] != "www.primary.test" {
+				t.Fatalf("读取 sitemap 时的 Host 为 %v", hosts)
+			}
+		})
+	}
+}
@@ -3,7 +3,9 @@ module seo/mirror
 go 1.22
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/glebarez/go-sqlite v1.22.0
+	github.com/klauspost/compress v1.17.11
 	github.com/liuzl/gocc v0.0.0-20231231122217-0372e1059ca5
 	github.com/wenzhenxi/gorsa v0.0.0-20230530123828-0320cce15d81
 	github.com/xuri/excelize/v2 v2.8.1
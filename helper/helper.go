@@ -1,8 +1,11 @@
 package helper
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
@@ -12,11 +15,15 @@ import (
 	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 	"golang.org/x/net/publicsuffix"
 )
 
@@ -236,25 +243,202 @@ func IsExist(path string) bool {
 
 }
 
+// ReadResponse 读取并解压源站响应的正文，解压后去掉 Content-Encoding
 func ReadResponse(response *http.Response, buffer *bytes.Buffer) error {
-	contentEncoding := response.Header.Get("Content-Encoding")
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	reader, err := DecodeReader(response.Body, response.Header.Get("Content-Encoding"))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	_, err = io.Copy(buffer, reader)
+	if err != nil {
+		return err
+	}
+	response.Header.Del("Content-Encoding")
+	return nil
+}
 
-	if contentEncoding == "gzip" {
-		reader, gzipErr := gzip.NewReader(response.Body)
-		if gzipErr != nil {
-			return gzipErr
+// DecodeReader 按 Content-Encoding 解压，多种压缩叠加时按相反的顺序逐层解压，不支持的压缩方式返回错误。
+// 返回的 Reader 关闭时只释放解压器，不关闭 body
+func DecodeReader(body io.Reader, contentEncoding string) (io.ReadCloser, error) {
+	//空正文即使声明了压缩方式也没有内容可以解压
+	buffered := bufio.NewReader(body)
+	if _, err := buffered.Peek(1); errors.Is(err, io.EOF) {
+		return &decodeReader{Reader: buffered}, nil
+	}
+	decoder := &decodeReader{Reader: buffered}
+	encodings := strings.Split(contentEncoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		switch encoding {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			reader, err := gzip.NewReader(decoder.Reader)
+			if err != nil {
+				_ = decoder.Close()
+				return nil, err
+			}
+			decoder.Reader = reader
+		case "deflate":
+			decoder.Reader = newDeflateReader(decoder.Reader)
+		case "br":
+			decoder.Reader = brotli.NewReader(decoder.Reader)
+		case "zstd":
+			reader, err := zstd.NewReader(decoder.Reader, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				_ = decoder.Close()
+				return nil, err
+			}
+			decoder.closers = append(decoder.closers, reader.IOReadCloser())
+			decoder.Reader = reader
+		default:
+			_ = decoder.Close()
+			return nil, fmt.Errorf("不支持的压缩方式:%s", encoding)
 		}
-		_, err := io.Copy(buffer, reader)
-		if err != nil {
-			return err
+	}
+	return decoder, nil
+}
+
+type decodeReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *decodeReader) Close() error {
+	for _, closer := range d.closers {
+		_ = closer.Close()
+	}
+	return nil
+}
+
+// newDeflateReader HTTP 的 deflate 应该带 zlib 头，有的服务器直接输出原始 deflate 数据，两种都支持
+func newDeflateReader(body io.Reader) io.Reader {
+	reader := bufio.NewReader(body)
+	header, err := reader.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		if zr, err := zlib.NewReader(reader); err == nil {
+			return zr
+		}
+	}
+	return flate.NewReader(reader)
+}
+
+// ProxyDirect 不使用出口代理
+const ProxyDirect = "direct"
+
+// ParseProxy 解析出口代理地址，支持 http、https、socks5、socks5h，账号密码写在地址中
+func ParseProxy(rawUrl string) (*url.URL, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("出口代理地址错误")
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, fmt.Errorf("不支持的出口代理类型:%s", u.Scheme)
+}
+
+// OriginFreshness 根据源站的 Cache-Control 和 Expires 计算缓存时间。
+// cacheable 为 false 表示源站禁止缓存，ok 为 false 表示源站没有给出缓存时间
+func OriginFreshness(header http.Header) (ttl time.Duration, cacheable bool, ok bool) {
+	maxAge, sMaxAge := -1, -1
+	for _, directive := range strings.Split(strings.ToLower(header.Get("Cache-Control")), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		value = strings.Trim(value, `"`)
+		switch name {
+		case "no-store", "private":
+			return 0, false, false
+		case "no-cache":
+			maxAge = 0
+		case "max-age":
+			if age, err := strconv.Atoi(value); err == nil && maxAge != 0 {
+				maxAge = age
+			}
+		case "s-maxage":
+			if age, err := strconv.Atoi(value); err == nil {
+				sMaxAge = age
+			}
 		}
-		return nil
 	}
-	_, err := io.Copy(buffer, response.Body)
+	if sMaxAge >= 0 {
+		return time.Duration(sMaxAge) * time.Second, true, true
+	}
+	if maxAge >= 0 {
+		return time.Duration(maxAge) * time.Second, true, true
+	}
+	expires := header.Get("Expires")
+	if expires == "" {
+		return 0, true, false
+	}
+	expiresTime, err := http.ParseTime(expires)
 	if err != nil {
-		return err
+		//无效的 Expires 视为已过期
+		return 0, true, true
+	}
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+	if expiresTime.Before(date) {
+		return 0, true, true
+	}
+	return expiresTime.Sub(date), true, true
+}
+
+// NotModified 判断客户端的条件请求是否命中，If-None-Match 优先于 If-Modified-Since
+func NotModified(request *http.Request, etag string, lastModified time.Time) bool {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return false
+	}
+	if ifNoneMatch := request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			//弱比较，忽略 W/ 前缀
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(request.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(ifModifiedSince)
+}
+
+var mobileKeywords = []string{"mobile", "android", "iphone", "ipad", "ipod", "windows phone", "harmonyos"}
+
+// IsMobile 根据 User-Agent 判断是否为移动设备
+func IsMobile(ua string) bool {
+	ua = strings.ToLower(ua)
+	for _, keyword := range mobileKeywords {
+		if strings.Contains(ua, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatSize 字节数转成便于阅读的大小
+func FormatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[i])
 	}
-	return response.Body.Close()
+	return fmt.Sprintf("%.2f%s", value, units[i])
 }
 
 func WrapResponseBody(response *http.Response, content []byte) {